@@ -0,0 +1,783 @@
+// Package abundance estimates relative abundances from read alignments
+// against a reference, using the bucketing data created by bundyx.
+package abundance
+
+import (
+	"fmt"
+	"iter"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/bxdb"
+	"github.com/fluhus/bundy/mask"
+	"github.com/fluhus/gostuff/gnum"
+	"github.com/fluhus/gostuff/sets"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Debug stuff.
+const (
+	denseSumNonZero = false
+	printSpecies    = ""
+	assertNZNonNeg  = true
+)
+
+var speciesToPrint = createPrintSpeciesMap()
+
+// Contig holds the bundyx data of a single reference sequence.
+type Contig struct {
+	Buckets  []int     // Boundaries of buckets.
+	BucketGC []float64 // GC fraction of each bucket, NaN if unknown. May be nil.
+	Profiles []Profile // Per read length, ordered like Options.ReadLens.
+}
+
+// Profile holds the bundyx data of a contig for a single read length.
+type Profile struct {
+	OK       int   // Total OK mappings.
+	All      int   // All positions.
+	BucketOK []int // OK mappings per bucket.
+}
+
+// Options configure an Estimator.
+type Options struct {
+	// Extracts the species name out of each contig name.
+	// Contigs with the same species name are grouped together.
+	// Nil means each contig is its own species.
+	NamePattern *regexp.Regexp
+
+	Params       *Params // Estimation parameters. Nil means defaults.
+	IgnoreLength bool    // Ignore genome lengths in normalization.
+	Paired       bool    // Alignments come from paired-end reads.
+
+	// Read lengths of the contig profiles. The profiles are weighted by
+	// how close the input reads' lengths are to them. May be nil if there
+	// is a single profile.
+	ReadLens []int
+
+	// Whether each profile was computed from paired-end reads, parallel to
+	// ReadLens. Only profiles that match Paired are used, unless there are
+	// none. Nil means all profiles are single-end.
+	ProfilePaired []bool
+
+	// Whether the bundyx buckets are balanced (see bxdb.Header.Balanced).
+	// Balanced buckets differ in size, so their sizes are taken from their
+	// boundaries. Otherwise all buckets of a contig count as equal in size.
+	Balanced bool
+
+	// Regions to exclude. Alignments to masked positions are not counted,
+	// and masked positions do not count towards genome lengths.
+	Mask *mask.Mask
+
+	// Number of bootstrap resamples of the buckets, for estimating the
+	// uncertainty of the abundances. 0 means no bootstrap.
+	Bootstrap int
+	Seed      uint64 // Random seed for bootstrap.
+}
+
+// PassStats holds counts from a single pass over the alignments.
+type PassStats struct {
+	All           int         `json:"all"`           // All primary alignments.
+	Unmapped      int         `json:"unmapped"`      // Unmapped alignments.
+	LowQual       int         `json:"lowQual"`       // Alignments below the quality threshold.
+	NReads        int         `json:"nReads"`        // Alignments that were counted.
+	Quals         map[int]int `json:"quals"`         // Number of alignments per mapping quality.
+	ReadLens      map[int]int `json:"readLens"`      // Number of alignments per read length.
+	Masked        int         `json:"masked"`        // Alignments to masked regions.
+	FilteredBinom int         `json:"filteredBinom"` // Genomes filtered by binomial error (second pass).
+}
+
+// An Estimator estimates relative abundances from alignments.
+//
+// Estimation takes two passes over the same alignments: the first pass finds
+// candidate genomes using high quality alignments, and the second pass
+// estimates their abundances using all the alignments.
+type Estimator struct {
+	opts    Options
+	params  Params
+	nameRE  *regexp.Regexp
+	entries map[string]*contigEntry
+	wl      sets.Set[string]   // Candidates from the first pass.
+	abnd    map[string]float64 // Abundances from the second pass.
+	weights []float64          // Weight of each read length profile.
+	gc      *GCCurve           // GC bias from the second pass.
+	genomes map[string]*GenomeStats
+	readLen float64 // Mean read length of the second pass.
+
+	// Aggregated data of the last pass, for bootstrap.
+	aggEntries map[string]*contigEntry
+	aggBuckets map[string][]float64
+}
+
+// GenomeStats holds a genome's abundance along with the evidence behind it.
+type GenomeStats struct {
+	Abundance   float64 `json:"abundance"`   // Relative abundance, sums up to 1 over genomes.
+	Reads       int     `json:"reads"`       // Alignments counted for the genome.
+	EstReads    float64 `json:"estReads"`    // Dense-sum estimated number of reads.
+	MeanDepth   float64 `json:"meanDepth"`   // Mean normalized depth over buckets.
+	MedianDepth float64 `json:"medianDepth"` // Median normalized depth over buckets.
+	Copies      float64 `json:"copies"`      // Estimated genome copies: dense-sum coverage over genome length.
+
+	// Bootstrap standard error and 95% percentile interval of the
+	// abundance. Zero if bootstrap is off.
+	StdErr float64 `json:"stdErr"`
+	CILow  float64 `json:"ciLow"`
+	CIHigh float64 `json:"ciHigh"`
+}
+
+// NewEstimator returns an estimator over the given bundyx data.
+// A nil opts is equivalent to zero options.
+func NewEstimator(db map[string]*Contig, opts *Options) *Estimator {
+	e := &Estimator{entries: map[string]*contigEntry{}}
+	if opts != nil {
+		e.opts = *opts
+	}
+	e.params = DefaultParams()
+	if e.opts.Params != nil {
+		e.params = *e.opts.Params
+	}
+	e.nameRE = e.opts.NamePattern
+	if e.nameRE == nil {
+		e.nameRE = regexp.MustCompile(".*")
+	}
+	for name, c := range db {
+		e.entries[name] = &contigEntry{
+			profiles: c.Profiles,
+			buckets:  &bucketOKs{pos: c.Buckets},
+			gc:       c.BucketGC,
+			name:     name,
+			mask:     e.opts.Mask,
+			balanced: e.opts.Balanced,
+		}
+	}
+	e.setWeights(nil)
+	return e
+}
+
+// ProfileWeights returns the weight of each read length profile, ordered
+// like Options.ReadLens. Set by FirstPass.
+func (e *Estimator) ProfileWeights() []float64 {
+	return e.weights
+}
+
+// Sets the profile weights according to the given read length histogram,
+// and updates the contig entries with the weighted profiles.
+// Only profiles of the input's kind (single or paired-end) are weighted.
+func (e *Estimator) setWeights(hist map[int]int) {
+	n := 1
+	for _, ce := range e.entries {
+		n = len(ce.profiles)
+		break
+	}
+	e.weights = make([]float64, n)
+	if len(e.opts.ReadLens) != n || n == 1 {
+		e.weights[0] = 1
+	} else {
+		idx := e.matchingProfiles()
+		lens := snm.Slice(len(idx), func(i int) int {
+			return e.opts.ReadLens[idx[i]]
+		})
+		for i, w := range profileWeights(lens, hist) {
+			e.weights[idx[i]] = w
+		}
+	}
+	for _, ce := range e.entries {
+		ce.applyWeights(e.weights)
+	}
+}
+
+// Returns the indexes of the profiles whose kind matches the input's,
+// or of all profiles if none match.
+func (e *Estimator) matchingProfiles() []int {
+	var idx []int
+	for i := range e.opts.ReadLens {
+		paired := i < len(e.opts.ProfilePaired) && e.opts.ProfilePaired[i]
+		if paired == e.opts.Paired {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) == 0 {
+		idx = snm.Slice(len(e.opts.ReadLens), func(i int) int { return i })
+	}
+	return idx
+}
+
+// Estimate runs both passes and returns the abundances.
+// sams should return an iterator over the same alignments each time
+// it is called.
+func (e *Estimator) Estimate(sams func() iter.Seq2[*sam.SAM, error],
+) (map[string]float64, error) {
+	if _, err := e.FirstPass(sams()); err != nil {
+		return nil, err
+	}
+	if _, err := e.SecondPass(sams()); err != nil {
+		return nil, err
+	}
+	return e.Abundances(), nil
+}
+
+// FirstPass counts high quality alignments and selects candidate genomes.
+func (e *Estimator) FirstPass(sams iter.Seq2[*sam.SAM, error],
+) (*PassStats, error) {
+	if err := e.params.Validate(); err != nil {
+		return nil, err
+	}
+	st, err := e.count(sams, e.params.QualThresh)
+	if err != nil {
+		return nil, err
+	}
+	e.setWeights(st.ReadLens)
+	e.wl = sets.FromKeys(
+		e.entriesToAbundances(e.params.DenseSumRatio, e.params.MinNZ, 0, nil))
+	for _, ce := range e.entries {
+		ce.counts = nil
+	}
+	return st, nil
+}
+
+// SecondPass counts all alignments and estimates the abundances of the
+// candidate genomes. Should be called after FirstPass.
+func (e *Estimator) SecondPass(sams iter.Seq2[*sam.SAM, error],
+) (*PassStats, error) {
+	if e.wl == nil {
+		return nil, fmt.Errorf("second pass called before first pass")
+	}
+	st, err := e.count(sams, e.params.QualThresh2)
+	if err != nil {
+		return nil, err
+	}
+	if e.params.GCCorrect {
+		e.gc = e.fitGC()
+	}
+	e.readLen = e.meanReadLen(st.ReadLens)
+	abnd := e.entriesToAbundances(e.params.DenseSumRatio2, e.params.MinNZ2,
+		e.params.MaxBinomialErr, &st.FilteredBinom)
+	e.abnd = snm.FilterMap(abnd, func(s string, f float64) bool {
+		return e.wl.Has(s)
+	})
+	toSum1(e.abnd)
+	e.genomes = snm.FilterMap(e.genomes, func(s string, g *GenomeStats) bool {
+		return e.abnd[s] != 0
+	})
+	for s, g := range e.genomes {
+		g.Abundance = e.abnd[s]
+	}
+	if e.opts.Bootstrap > 0 {
+		e.bootstrap()
+	}
+	return st, nil
+}
+
+// Genomes returns the abundances estimated in the second pass along with
+// their supporting counts. Depths and copies are 0 if the read lengths are
+// unknown.
+func (e *Estimator) Genomes() map[string]*GenomeStats {
+	return e.genomes
+}
+
+// Returns the mean read length according to the given histogram, or
+// according to the profile weights if the histogram is empty.
+// Returns 0 if neither is known.
+func (e *Estimator) meanReadLen(hist map[int]int) float64 {
+	sum, n := 0.0, 0.0
+	for l, c := range hist {
+		sum += float64(l * c)
+		n += float64(c)
+	}
+	if n > 0 {
+		return sum / n
+	}
+	if len(e.opts.ReadLens) != len(e.weights) {
+		return 0
+	}
+	for i, w := range e.weights {
+		sum += w * float64(e.opts.ReadLens[i])
+	}
+	return sum
+}
+
+// Candidates returns the candidate genomes found in the first pass.
+func (e *Estimator) Candidates() sets.Set[string] {
+	return e.wl
+}
+
+// Abundances returns the abundances estimated in the second pass.
+// Values sum up to 1.
+func (e *Estimator) Abundances() map[string]float64 {
+	return e.abnd
+}
+
+// RawCounts returns the number of alignments counted per candidate genome
+// in the last pass.
+func (e *Estimator) RawCounts() map[string]float64 {
+	abnd := map[string]float64{}
+	for s, ce := range e.entries {
+		match := e.nameRE.FindString(s)
+		abnd[match] += float64(gnum.Sum(ce.counts))
+	}
+	return snm.FilterMap(abnd, func(s string, f float64) bool {
+		return e.wl.Has(s)
+	})
+}
+
+// Used returns whether the given alignment contributed to the abundance
+// of a detected genome. Should be called after SecondPass.
+func (e *Estimator) Used(sm *sam.SAM) bool {
+	return IsPrimary(sm) && e.samMapped(sm) &&
+		sm.Mapq >= e.params.QualThresh2 &&
+		e.abnd[e.nameRE.FindString(sm.Rname)] != 0
+}
+
+// Adds the alignments that pass the quality threshold to the counts.
+func (e *Estimator) count(sams iter.Seq2[*sam.SAM, error], qual int,
+) (*PassStats, error) {
+	st := &PassStats{Quals: map[int]int{}, ReadLens: map[int]int{}}
+	for sm, err := range sams {
+		if err != nil {
+			return nil, err
+		}
+		if !IsPrimary(sm) {
+			continue
+		}
+		st.All++
+		if sm.Seq != "*" && sm.Seq != "" {
+			st.ReadLens[len(sm.Seq)]++
+		}
+		if sm.Flag&sam.FlagUnmapped != 0 {
+			st.Unmapped++
+			continue
+		}
+		st.Quals[sm.Mapq]++
+		if sm.Mapq < qual {
+			st.LowQual++
+			continue
+		}
+		ce := e.entries[sm.Rname]
+		if ce == nil {
+			return nil, fmt.Errorf("reference %q not found in bundyx data",
+				sm.Rname)
+		}
+		if e.opts.Mask != nil && e.opts.Mask.Has(sm.Rname, sm.Pos-1) {
+			st.Masked++
+			continue
+		}
+		st.NReads++
+		ce.addPos(sm.Pos)
+	}
+	return st, nil
+}
+
+// IsPrimary returns whether the given alignment is the primary record of its
+// read, rather than a secondary or supplementary alignment.
+func IsPrimary(sm *sam.SAM) bool {
+	return sm.Flag&(sam.FlagSecondary|sam.FlagSupplementary) == 0
+}
+
+// Returnes true if this SAM entry was mapped properly,
+// depending on whether it's single or paried end.
+// Entries flagged as paired are treated as such even if Paired is off,
+// to support pre-aligned input.
+func (e *Estimator) samMapped(sm *sam.SAM) bool {
+	paired := e.opts.Paired || sm.Flag&sam.FlagMultiple != 0
+	return (paired && sm.Flag&sam.FlagEach > 0) ||
+		(!paired && sm.Flag&sam.FlagUnmapped == 0)
+}
+
+type contigEntry struct {
+	ok       int        // Total OK mappings.
+	all      int        // All positions.
+	buckets  *bucketOKs // Per-bucket information.
+	counts   []int      // Mapping counts.
+	sum      float64    // Dense sum.
+	profiles []Profile  // Per read length information.
+	masked   []int      // Masked positions per bucket, nil if none.
+	name     string     // Contig name, for looking up the mask.
+	mask     *mask.Mask // Regions to exclude, may be nil.
+	gc       []float64  // GC fraction per bucket, nil if unknown.
+	balanced bool       // Bucket sizes follow the boundaries.
+}
+
+// Sets the entry's OK and all counts to the weighted sum of its profiles.
+func (e *contigEntry) applyWeights(w []float64) {
+	var ok, all float64
+	bok := make([]float64, len(e.profiles[0].BucketOK))
+	for i, p := range e.profiles {
+		ok += w[i] * float64(p.OK)
+		all += w[i] * float64(p.All)
+		for j, b := range p.BucketOK {
+			bok[j] += w[i] * float64(b)
+		}
+	}
+	e.ok = int(math.Round(ok))
+	e.all = int(math.Round(all))
+	e.buckets.ok = snm.Slice(len(bok), func(i int) int {
+		return int(math.Round(bok[i]))
+	})
+	e.masked = bucketsMasked(e.mask, e.name, e.buckets.pos, e.all)
+}
+
+// Returns the weight of each read length profile given a histogram of the
+// input's read lengths. Each read is split between the two profiles closest
+// to its length, by linear interpolation. Reads outside the profiles' range
+// go to the closest profile.
+func profileWeights(lens []int, hist map[int]int) []float64 {
+	idx := snm.Slice(len(lens), func(i int) int { return i })
+	sort.Slice(idx, func(i, j int) bool { return lens[idx[i]] < lens[idx[j]] })
+	w := make([]float64, len(lens))
+	total := 0.0
+	for l, n := range hist {
+		nf := float64(n)
+		total += nf
+		j := sort.Search(len(idx), func(i int) bool {
+			return lens[idx[i]] >= l
+		})
+		switch {
+		case j == 0:
+			w[idx[0]] += nf
+		case j == len(idx):
+			w[idx[j-1]] += nf
+		case lens[idx[j]] == l:
+			w[idx[j]] += nf
+		default:
+			a, b := lens[idx[j-1]], lens[idx[j]]
+			f := float64(l-a) / float64(b-a)
+			w[idx[j-1]] += nf * (1 - f)
+			w[idx[j]] += nf * f
+		}
+	}
+	if total == 0 { // No reads, use the first profile.
+		w[0], total = 1, 1
+	}
+	for i := range w {
+		w[i] /= total
+	}
+	return w
+}
+
+type bucketOKs struct {
+	pos []int // Boundries of buckets.
+	ok  []int // OK mappings per bucket.
+}
+
+// Returns the size of the i'th bucket, excluding masked positions. Only
+// balanced buckets take their size from the boundaries, others get an equal
+// share of the contig. Returns 0 for fully masked buckets.
+func (e *contigEntry) bucketSize(i int) int {
+	start, end := bucketRange(e.buckets.pos, i, e.all)
+	size := end - start
+	if !e.balanced {
+		size = e.all / (len(e.buckets.pos) + 1)
+	}
+	if e.masked != nil {
+		if e.masked[i] >= end-start {
+			return 0
+		}
+		size -= e.masked[i]
+	}
+	return max(size, 0)
+}
+
+// Returns the start and end positions of the i'th bucket, clipped to the
+// contig's length.
+func bucketRange(bounds []int, i, length int) (int, int) {
+	start, end := 0, length
+	if i > 0 {
+		start = min(bounds[i-1], length)
+	}
+	if i < len(bounds) {
+		end = min(bounds[i], length)
+	}
+	return start, end
+}
+
+// Returns the contig's length, excluding masked positions.
+func (e *contigEntry) unmaskedLen() int {
+	return e.all - gnum.Sum(e.masked)
+}
+
+// Returns the number of masked positions in each bucket of the given contig,
+// or nil if nothing is masked. Positions past the contig's length are
+// ignored.
+func bucketsMasked(m *mask.Mask, name string, bounds []int, length int) []int {
+	if m == nil || m.Overlap(name, 0, length) == 0 {
+		return nil
+	}
+	return snm.Slice(len(bounds)+1, func(i int) int {
+		start, end := bucketRange(bounds, i, length)
+		return m.Overlap(name, start, end)
+	})
+}
+
+// Returns the count of the i'th bucket, normalized by the bucket's
+// mappability. Returns false if the bucket has too little unique sequence,
+// or is fully masked.
+func (e *contigEntry) normCount(i int) (float64, bool) {
+	bucketSize := e.bucketSize(i)
+	if bucketSize == 0 || e.buckets.ok[i] < bucketSize/10 {
+		return 0, false
+	}
+	cnt := 0
+	if len(e.counts) > 0 {
+		cnt = e.counts[i]
+	}
+	return float64(cnt) * float64(bucketSize) / float64(e.buckets.ok[i]), true
+}
+
+// Adds one count to the bucket at the given position.
+func (e *contigEntry) addPos(pos int) {
+	if e.counts == nil {
+		e.counts = make([]int, len(e.buckets.ok))
+	}
+	bucket := sort.SearchInts(e.buckets.pos, pos)
+	e.counts[bucket]++
+}
+
+// Load loads bundyx data from the files matching the given glob pattern.
+// Returns the build parameters shared by all files, or nil if the files are
+// in the legacy format. Fails on duplicate contigs and on missing parts.
+func Load(glob string) (map[string]*Contig, *bxdb.Header, error) {
+	result := map[string]*Contig{}
+	var parts []int
+	files := bxdb.Glob(glob)
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no OKs files found")
+	}
+
+	var h *bxdb.Header
+	for i, file := range files {
+		r, err := bxdb.Open(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			h = r.Header
+		}
+		if (h == nil) != (r.Header == nil) {
+			r.Close()
+			return nil, nil, fmt.Errorf("%s: mixed legacy and versioned "+
+				"bundyx files", file)
+		}
+		if h != nil {
+			if err := h.SameBuild(r.Header); err != nil {
+				r.Close()
+				return nil, nil, fmt.Errorf("%s: %w", file, err)
+			}
+			parts = append(parts, r.Header.Part)
+		}
+		for c, err := range r.Iter() {
+			if err != nil {
+				r.Close()
+				return nil, nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if result[c.Name] != nil {
+				r.Close()
+				return nil, nil, fmt.Errorf("%s: duplicate contig: %q",
+					file, c.Name)
+			}
+			result[c.Name] = &Contig{Buckets: c.Buckets, BucketGC: c.BucketGC,
+				Profiles: snm.Slice(len(c.Profiles), func(i int) Profile {
+					p := c.Profiles[i]
+					return Profile{OK: p.OK, All: p.All, BucketOK: p.BucketOK}
+				})}
+		}
+		r.Close()
+	}
+	if h != nil {
+		if m := bxdb.MissingParts(parts, h.NParts); len(m) > 0 {
+			return nil, nil, fmt.Errorf("%d of %d bundyx parts are missing, "+
+				"for example part %d", len(m), h.NParts, m[0])
+		}
+		hh := *h
+		hh.Part = 0
+		h = &hh
+	}
+	return result, h, nil
+}
+
+// Returns a map from species to relative abundance.
+// If filteredBinom is non-nil, it is set to the number of species
+// filtered by binomial error.
+func (e *Estimator) entriesToAbundances(ratio int, mz float64,
+	maxBinom float64, filteredBinom *int) map[string]float64 {
+	abnd := map[string]float64{}
+	aggEntries := snm.NewDefaultMap(func(s string) *contigEntry {
+		return &contigEntry{counts: []int{0}}
+	})
+	aggBuckets := map[string][]float64{} // TODO(amit): See if I can get rid of this.
+	aggOK := map[string]int{}            // Original OKs before subtracting in normCounts, for debugging.
+	aggDepths := map[string][]float64{}  // Normalized reads per base in each bucket.
+	reads := map[string]int{}
+	for s, ce := range e.entries {
+		match := e.nameRE.FindString(s)
+		agg := aggEntries.Get(match)
+		agg.all += ce.unmaskedLen()
+		agg.ok += ce.ok
+		aggOK[match] += len(ce.buckets.ok)
+		reads[match] += gnum.Sum(ce.counts)
+		normCounts := snm.Slice(len(ce.buckets.ok), func(i int) float64 {
+			cnt, ok := ce.normCount(i)
+			if !ok {
+				agg.ok -= ce.buckets.ok[i]
+				agg.all -= ce.bucketSize(i)
+				return math.NaN()
+			}
+			if e.gc != nil && ce.gc != nil {
+				cnt /= e.gc.factor(ce.gc[i])
+			}
+			if !math.IsNaN(cnt) && !math.IsInf(cnt, 0) {
+				aggDepths[match] = append(aggDepths[match],
+					cnt/float64(ce.bucketSize(i)))
+			}
+			return cnt
+		})
+
+		normCounts = snm.FilterSlice(normCounts, func(f float64) bool {
+			return !math.IsNaN(f) && !math.IsInf(f, 0)
+		})
+		aggBuckets[match] = append(aggBuckets[match], normCounts...)
+	}
+	nFiltered := 0
+	e.genomes = map[string]*GenomeStats{}
+	for s, agg := range aggEntries.M {
+		if printSpecies != "" && speciesToPrint[s] {
+			toPrint := fmt.Sprintf("%.0f", aggBuckets[s])
+			nzeros := len(snm.FilterSlice(aggBuckets[s], func(f float64) bool {
+				return f == 0
+			}))
+			pzeros := float64(nzeros) / float64(len(aggBuckets[s])) * 100
+			nzperc := fmt.Sprintf("%.0f%%", 100-pzeros)
+			binerr := fmt.Sprintf("%.2f", binomialError(aggBuckets[s], aggOK[s]))
+			fmt.Fprintln(os.Stderr, s, len(aggBuckets[s]), aggOK[s], nzperc, binerr, toPrint)
+		}
+		agg.sum = fDenseSum(aggBuckets[s], ratio, mz)
+		if agg.sum > 0 && maxBinom > 0 && binomialError(aggBuckets[s], aggOK[s]) > maxBinom {
+			agg.sum = 0
+			nFiltered++
+		}
+		if agg.sum == 0 || agg.ok == 0 {
+			continue
+		}
+		abnd[s] = e.lengthNorm(agg, agg.sum)
+		e.genomes[s] = &GenomeStats{
+			Reads:       reads[s],
+			EstReads:    agg.sum,
+			MeanDepth:   gnum.Mean(aggDepths[s]) * e.readLen,
+			MedianDepth: median(aggDepths[s]) * e.readLen,
+			Copies:      agg.sum * e.readLen / float64(max(agg.all, 1)),
+		}
+	}
+	if filteredBinom != nil {
+		*filteredBinom = nFiltered
+	}
+	e.aggEntries, e.aggBuckets = aggEntries.M, aggBuckets
+	toSum1(abnd)
+	return abnd
+}
+
+// Returns the given dense sum of an aggregated genome entry, normalized
+// by the genome's length.
+func (e *Estimator) lengthNorm(agg *contigEntry, sum float64) float64 {
+	if !e.opts.IgnoreLength {
+		return sum / float64(agg.all)
+	}
+	return sum * float64(agg.all) / float64(agg.ok)
+}
+
+// Returns the median of a, or 0 if empty.
+func median(a []float64) float64 {
+	if len(a) == 0 {
+		return 0
+	}
+	a = slices.Clone(a)
+	slices.Sort(a)
+	n := len(a)
+	if n%2 == 1 {
+		return a[n/2]
+	}
+	return (a[n/2-1] + a[n/2]) / 2
+}
+
+// Returns the sum of a, discarding some outliers.
+func fDenseSum(a []float64, ratio int, nz float64) float64 {
+	if assertNZNonNeg && nz < 0 { // Debug assert.
+		panic(fmt.Sprintf("negative nz: %f", nz))
+	}
+	// No use for a window. For len=2 it will return the lower value.
+	if len(a) <= 1 {
+		return gnum.Sum(a)
+	}
+
+	// Actual dense sum.
+	sort.Float64s(a)
+	if nz != 0 {
+		i := len(a) - 1 - iround(float64(len(a)-1)*nz)
+		if a[i] == 0 {
+			return 0 // Too many zeros.
+		}
+	}
+	n := len(a)
+	if denseSumNonZero {
+		a = snm.FilterSlice(a, func(f float64) bool { return f > 0 })
+		if len(a) <= 1 {
+			return gnum.Sum(a) * float64(n)
+		}
+	}
+
+	winlen := len(a)
+	if ratio > 1 {
+		winlen = gnum.Idiv(len(a)*(ratio-1), ratio)
+		if winlen == len(a) {
+			winlen--
+		}
+	}
+
+	min, pos := math.Inf(1), 0
+	for i := range a[winlen-1:] { // We have winlen+1 windows.
+		diff := a[i+winlen-1] - a[i]
+		if diff < min {
+			min, pos = diff, i
+		}
+	}
+	return gnum.Sum(a[pos:pos+winlen]) * float64(n) / float64(winlen)
+}
+
+// Returns a float as an integer, rounded to the nearest whole.
+func iround(f float64) int {
+	return int(math.Round(f))
+}
+
+// Populates the species debug map according to the constant.
+func createPrintSpeciesMap() map[string]bool {
+	if printSpecies == "" {
+		return nil
+	}
+	m := map[string]bool{}
+	for _, s := range strings.Split(printSpecies, ",") {
+		m[s] = true
+	}
+	return m
+}
+
+// Normalizes m's values to sum up to 1.
+func toSum1(m map[string]float64) {
+	sum := gnum.Sum(maps.Values(m))
+	if sum == 0 {
+		return
+	}
+	for k := range m {
+		m[k] /= sum
+	}
+}
+
+// Returns the binomial STD for the given params.
+func binomialError(abnd []float64, nn int) float64 {
+	n := len(abnd)
+	k := gnum.Sum(abnd)
+	q := float64(nn-n) / float64(nn)
+	return math.Sqrt(q / k)
+}
@@ -0,0 +1,338 @@
+package abundance
+
+import (
+	"iter"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/mask"
+	"github.com/fluhus/gostuff/sets"
+	"github.com/fluhus/gostuff/snm"
+)
+
+func TestFDenseSum(t *testing.T) {
+	tests := []struct {
+		a     []float64
+		ratio int
+		nz    float64
+		want  float64
+	}{
+		{[]float64{5}, 20, 0, 5},
+		{[]float64{1, 2, 3, 4}, 0, 0, 10},
+		{[]float64{10, 10, 10, 1000}, 4, 0, 40},
+		{[]float64{0, 0, 0, 5}, 20, 0.66, 0},
+	}
+	for _, test := range tests {
+		got := fDenseSum(test.a, test.ratio, test.nz)
+		if math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("fDenseSum(%v,%v,%v)=%v, want %v",
+				test.a, test.ratio, test.nz, got, test.want)
+		}
+	}
+}
+
+func TestEstimator(t *testing.T) {
+	db := map[string]*Contig{
+		"a": {Buckets: []int{1000}, Profiles: []Profile{
+			{OK: 2000, All: 2000, BucketOK: []int{1000, 1000}}}},
+		"b": {Buckets: []int{1000}, Profiles: []Profile{
+			{OK: 2000, All: 2000, BucketOK: []int{1000, 1000}}}},
+	}
+	var sams []*sam.SAM
+	for i := range 300 {
+		name := "a"
+		if i%3 == 0 {
+			name = "b"
+		}
+		sams = append(sams, &sam.SAM{Rname: name, Pos: 1 + i*6, Mapq: 40})
+	}
+	// Secondary and supplementary alignments should not be counted.
+	for i := range 50 {
+		sams = append(sams,
+			&sam.SAM{Rname: "b", Pos: 1 + i*6, Mapq: 40,
+				Flag: sam.FlagSecondary},
+			&sam.SAM{Rname: "b", Pos: 1 + i*6, Mapq: 40,
+				Flag: sam.FlagSupplementary})
+	}
+	sams = append(sams, &sam.SAM{Rname: "c", Mapq: 40,
+		Flag: sam.FlagUnmapped | sam.FlagMultiple})
+	sams = append(sams, &sam.SAM{Flag: sam.FlagUnmapped})
+	samsIter := func() iter.Seq2[*sam.SAM, error] {
+		return func(yield func(*sam.SAM, error) bool) {
+			for _, sm := range sams {
+				if !yield(sm, nil) {
+					return
+				}
+			}
+		}
+	}
+
+	e := NewEstimator(db, nil)
+	got, err := e.Estimate(samsIter)
+	if err != nil {
+		t.Fatalf("Estimate() failed: %v", err)
+	}
+	want := map[string]float64{"a": 2.0 / 3, "b": 1.0 / 3}
+	if len(got) != len(want) {
+		t.Fatalf("Estimate()=%v, want %v", got, want)
+	}
+	for k, v := range want {
+		if math.Abs(got[k]-v) > 0.01 {
+			t.Fatalf("Estimate()=%v, want %v", got, want)
+		}
+	}
+	if !e.Used(sams[0]) || e.Used(sams[len(sams)-1]) || e.Used(sams[300]) {
+		t.Errorf("Used() returned unexpected values")
+	}
+	g := e.Genomes()
+	if g["a"] == nil || g["a"].Reads != 200 || g["b"] == nil ||
+		g["b"].Reads != 100 {
+		t.Fatalf("Genomes()=%v, want reads a=200 b=100", g)
+	}
+	if g["a"].Abundance != got["a"] || g["a"].EstReads <= 0 ||
+		g["a"].MeanDepth != 0 {
+		t.Errorf("Genomes()[a]=%+v, want abundance %v and no depth",
+			*g["a"], got["a"])
+	}
+}
+
+func TestProfileWeights(t *testing.T) {
+	tests := []struct {
+		lens []int
+		hist map[int]int
+		want []float64
+	}{
+		{[]int{100}, map[int]int{150: 3}, []float64{1}},
+		{[]int{75, 150, 100}, map[int]int{100: 1}, []float64{0, 0, 1}},
+		{[]int{75, 150, 100}, map[int]int{50: 1, 200: 1}, []float64{0.5, 0.5, 0}},
+		{[]int{100, 150}, map[int]int{110: 1}, []float64{0.8, 0.2}},
+		{[]int{100, 150}, nil, []float64{1, 0}},
+	}
+	for _, test := range tests {
+		got := profileWeights(test.lens, test.hist)
+		if len(got) != len(test.want) {
+			t.Fatalf("profileWeights(%v,%v)=%v, want %v",
+				test.lens, test.hist, got, test.want)
+		}
+		for i := range got {
+			if math.Abs(got[i]-test.want[i]) > 0.0001 {
+				t.Fatalf("profileWeights(%v,%v)=%v, want %v",
+					test.lens, test.hist, got, test.want)
+			}
+		}
+	}
+}
+
+func TestPairedProfiles(t *testing.T) {
+	db := map[string]*Contig{
+		"a": {Profiles: []Profile{{OK: 1, All: 2}, {OK: 2, All: 2}}},
+	}
+	tests := []struct {
+		paired        bool
+		profilePaired []bool
+		want          []float64
+	}{
+		{false, []bool{false, true}, []float64{1, 0}},
+		{true, []bool{false, true}, []float64{0, 1}},
+		{true, nil, []float64{1, 0}},
+	}
+	for _, test := range tests {
+		e := NewEstimator(db, &Options{Paired: test.paired,
+			ReadLens: []int{100, 100}, ProfilePaired: test.profilePaired})
+		got := e.ProfileWeights()
+		if !slices.Equal(got, test.want) {
+			t.Errorf("ProfileWeights(%v,%v)=%v, want %v",
+				test.paired, test.profilePaired, got, test.want)
+		}
+	}
+}
+
+func TestBucketSize(t *testing.T) {
+	ce := &contigEntry{all: 2500, buckets: &bucketOKs{pos: []int{1000, 2000}}}
+	got := snm.Slice(3, ce.bucketSize)
+	if want := []int{833, 833, 833}; !slices.Equal(got, want) {
+		t.Errorf("bucketSize(...)=%v, want %v", got, want)
+	}
+	ce.balanced = true
+	got = snm.Slice(3, ce.bucketSize)
+	if want := []int{1000, 1000, 500}; !slices.Equal(got, want) {
+		t.Errorf("bucketSize(...)=%v, want %v", got, want)
+	}
+}
+
+func TestMaskedBuckets(t *testing.T) {
+	m, err := mask.Read(strings.NewReader("a\t500\t1500\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := []int{1000, 2000}
+	ce := &contigEntry{all: 3000, buckets: &bucketOKs{pos: bounds},
+		masked: bucketsMasked(m, "a", bounds, 3000)}
+	got := snm.Slice(3, ce.bucketSize)
+	if want := []int{500, 500, 1000}; !slices.Equal(got, want) {
+		t.Errorf("bucketSize(...)=%v, want %v", got, want)
+	}
+	if got := ce.unmaskedLen(); got != 2000 {
+		t.Errorf("unmaskedLen()=%v, want 2000", got)
+	}
+	if got := bucketsMasked(m, "b", bounds, 3000); got != nil {
+		t.Errorf("bucketsMasked(b)=%v, want nil", got)
+	}
+
+	// Whole buckets masked, with the mask reaching past the contig's end.
+	m, err = mask.Read(strings.NewReader("a\t1000\t2000\na\t2500\t5000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce = &contigEntry{all: 2500, buckets: &bucketOKs{pos: bounds,
+		ok: []int{1000, 1000, 500}}, masked: bucketsMasked(m, "a", bounds, 2500),
+		balanced: true}
+	if want := []int{0, 1000, 0}; !slices.Equal(ce.masked, want) {
+		t.Errorf("bucketsMasked(...)=%v, want %v", ce.masked, want)
+	}
+	got = snm.Slice(3, ce.bucketSize)
+	if want := []int{1000, 0, 500}; !slices.Equal(got, want) {
+		t.Errorf("bucketSize(...)=%v, want %v", got, want)
+	}
+	if _, ok := ce.normCount(1); ok {
+		t.Errorf("normCount(1) succeeded, want dropped")
+	}
+	m, err = mask.Read(strings.NewReader("a\t2000\t9000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce.masked = bucketsMasked(m, "a", bounds, 2500)
+	if got := ce.bucketSize(2); got != 0 {
+		t.Errorf("bucketSize(2)=%v, want 0", got)
+	}
+	if _, ok := ce.normCount(2); ok {
+		t.Errorf("normCount(2) succeeded, want dropped")
+	}
+
+	// Buckets that are not balanced are equal in size.
+	ce = &contigEntry{all: 2500, buckets: &bucketOKs{pos: bounds}}
+	ce.masked = bucketsMasked(m, "a", bounds, 2500)
+	got = snm.Slice(3, ce.bucketSize)
+	if want := []int{833, 833, 0}; !slices.Equal(got, want) {
+		t.Errorf("bucketSize(...)=%v, want %v", got, want)
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	nan := math.NaN()
+	a := []float64{nan, 1, nan, nan, nan, 2, nan}
+	fillGaps(a)
+	if want := []float64{1, 1, 1, 1, 2, 2, 2}; !slices.Equal(a, want) {
+		t.Errorf("fillGaps(...)=%v, want %v", a, want)
+	}
+}
+
+func TestFitGC(t *testing.T) {
+	// Low GC buckets get twice the coverage of high GC buckets.
+	n := 20
+	ce := &contigEntry{all: 2 * n * 100, profiles: []Profile{{}},
+		buckets: &bucketOKs{}}
+	for i := range 2 * n {
+		if i > 0 {
+			ce.buckets.pos = append(ce.buckets.pos, i*100)
+		}
+		ce.buckets.ok = append(ce.buckets.ok, 100)
+		ce.gc = append(ce.gc, 0.2+0.5*float64(i%2))
+		ce.counts = append(ce.counts, 20-10*(i%2))
+	}
+	e := NewEstimator(nil, nil)
+	e.entries = map[string]*contigEntry{"a": ce}
+	e.wl = sets.Of("a")
+	c := e.fitGC()
+	if c == nil {
+		t.Fatalf("fitGC()=nil, want curve")
+	}
+	lo, hi := c.factor(0.2), c.factor(0.7)
+	if math.Abs(lo-4.0/3) > 0.0001 || math.Abs(hi-2.0/3) > 0.0001 {
+		t.Errorf("factor(0.2),factor(0.7)=%v,%v, want %v,%v",
+			lo, hi, 4.0/3, 2.0/3)
+	}
+	if got := c.factor(0); got != lo {
+		t.Errorf("factor(0)=%v, want %v", got, lo)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	a := []float64{1, 2, 3, 4, 5}
+	tests := []struct {
+		p, want float64
+	}{{0, 1}, {0.5, 3}, {0.625, 3.5}, {1, 5}}
+	for _, test := range tests {
+		if got := percentile(a, test.p); math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("percentile(%v,%v)=%v, want %v", a, test.p, got,
+				test.want)
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	db := map[string]*Contig{}
+	var sams []*sam.SAM
+	for _, name := range []string{"a", "b"} {
+		c := &Contig{Profiles: []Profile{{OK: 20000, All: 20000}}}
+		for i := range 20 {
+			if i > 0 {
+				c.Buckets = append(c.Buckets, i*1000)
+			}
+			c.Profiles[0].BucketOK = append(c.Profiles[0].BucketOK, 1000)
+			n := 10 + i%3
+			if name == "b" {
+				n = 5
+			}
+			for j := range n {
+				sams = append(sams, &sam.SAM{Rname: name,
+					Pos: 1 + i*1000 + j*50, Mapq: 40})
+			}
+		}
+		db[name] = c
+	}
+	samsIter := func() iter.Seq2[*sam.SAM, error] {
+		return func(yield func(*sam.SAM, error) bool) {
+			for _, sm := range sams {
+				if !yield(sm, nil) {
+					return
+				}
+			}
+		}
+	}
+
+	e := NewEstimator(db, &Options{Bootstrap: 50, Seed: 1})
+	if _, err := e.Estimate(samsIter); err != nil {
+		t.Fatalf("Estimate() failed: %v", err)
+	}
+	for name, g := range e.Genomes() {
+		if g.StdErr <= 0 || g.CILow > g.Abundance || g.CIHigh < g.Abundance {
+			t.Errorf("Genomes()[%s]=%+v, want interval around abundance",
+				name, *g)
+		}
+	}
+
+	// Same seed, same intervals.
+	for range 5 {
+		e2 := NewEstimator(db, &Options{Bootstrap: 50, Seed: 1})
+		if _, err := e2.Estimate(samsIter); err != nil {
+			t.Fatalf("Estimate() failed: %v", err)
+		}
+		if !reflect.DeepEqual(e2.Genomes(), e.Genomes()) {
+			t.Fatalf("Genomes()=%v, want %v", e2.Genomes(), e.Genomes())
+		}
+	}
+}
+
+func TestToSum1_zero(t *testing.T) {
+	m := map[string]float64{"a": 0, "b": 0}
+	toSum1(m)
+	want := map[string]float64{"a": 0, "b": 0}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("toSum1(...)=%v, want %v", m, want)
+	}
+}
@@ -0,0 +1,68 @@
+package abundance
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/fluhus/gostuff/gnum"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Percentiles of the reported confidence intervals.
+const ciLow, ciHigh = 0.025, 0.975
+
+// Resamples the buckets of each detected genome with replacement, and
+// recomputes the abundances of the detected genomes from the resampled
+// buckets. Sets the standard errors and intervals of the genome stats.
+// Should be called at the end of the second pass.
+func (e *Estimator) bootstrap() {
+	rnd := rand.New(rand.NewPCG(e.opts.Seed, e.opts.Seed))
+	// Sorted so that the same seed gives the same draws.
+	names := snm.Sorted(maps.Keys(e.genomes))
+	samples := map[string][]float64{}
+	for range e.opts.Bootstrap {
+		abnd := map[string]float64{}
+		for _, s := range names {
+			a := resample(e.aggBuckets[s], rnd)
+			sum := fDenseSum(a, e.params.DenseSumRatio2, e.params.MinNZ2)
+			abnd[s] = e.lengthNorm(e.aggEntries[s], sum)
+		}
+		toSum1(abnd)
+		for s, f := range abnd {
+			samples[s] = append(samples[s], f)
+		}
+	}
+	for s, g := range e.genomes {
+		a := samples[s]
+		g.StdErr = math.Sqrt(gnum.Var(a))
+		slices.Sort(a)
+		g.CILow = percentile(a, ciLow)
+		g.CIHigh = percentile(a, ciHigh)
+	}
+}
+
+// Returns a sample of the same size as a, drawn from a with replacement.
+func resample(a []float64, rnd *rand.Rand) []float64 {
+	result := make([]float64, len(a))
+	for i := range result {
+		result[i] = a[rnd.IntN(len(a))]
+	}
+	return result
+}
+
+// Returns the p'th percentile of the sorted slice a, using linear
+// interpolation between the closest ranks.
+func percentile(a []float64, p float64) float64 {
+	if len(a) == 0 {
+		return 0
+	}
+	x := p * float64(len(a)-1)
+	i := int(x)
+	if i+1 >= len(a) {
+		return a[len(a)-1]
+	}
+	f := x - float64(i)
+	return a[i]*(1-f) + a[i+1]*f
+}
@@ -0,0 +1,113 @@
+package abundance
+
+import (
+	"math"
+)
+
+const (
+	gcBins       = 20  // Number of GC bins in a GCCurve, of equal width.
+	minGCBuckets = 10  // Minimal number of buckets for fitting a GC bin.
+	minGCFactor  = 0.1 // Correction factors are clamped to [minGCFactor, 1/minGCFactor].
+)
+
+// GCCurve is the relative coverage of buckets by their GC content, fitted
+// over the buckets of the candidate genomes. A relative coverage of 1 means
+// no bias.
+type GCCurve struct {
+	Coverage []float64 `json:"coverage"` // Relative coverage per GC bin, bins span 0 to 1.
+	Buckets  []int     `json:"buckets"`  // Number of buckets per GC bin.
+}
+
+// GCCurve returns the fitted GC bias curve. Set by SecondPass if GC
+// correction is on and there are enough buckets with GC data.
+func (e *Estimator) GCCurve() *GCCurve {
+	return e.gc
+}
+
+// Returns the bin of the given GC fraction.
+func gcBin(gc float64) int {
+	return min(max(int(gc*gcBins), 0), gcBins-1)
+}
+
+// Returns the factor by which to divide the count of a bucket with the
+// given GC fraction.
+func (c *GCCurve) factor(gc float64) float64 {
+	if math.IsNaN(gc) {
+		return 1
+	}
+	return min(max(c.Coverage[gcBin(gc)], minGCFactor), 1/minGCFactor)
+}
+
+// Fits a GC curve over the normalized bucket counts of the candidate
+// genomes. Each bucket's count is taken relative to its genome's mean.
+// Returns nil if no bin has enough buckets.
+func (e *Estimator) fitGC() *GCCurve {
+	type point struct{ gc, cnt float64 }
+	genomes := map[string][]point{}
+	for s, ce := range e.entries {
+		match := e.nameRE.FindString(s)
+		if ce.gc == nil || !e.wl.Has(match) {
+			continue
+		}
+		for i := range ce.buckets.ok {
+			cnt, ok := ce.normCount(i)
+			if !ok || math.IsInf(cnt, 0) || math.IsNaN(ce.gc[i]) {
+				continue
+			}
+			genomes[match] = append(genomes[match], point{ce.gc[i], cnt})
+		}
+	}
+
+	sums := make([]float64, gcBins)
+	c := &GCCurve{Coverage: make([]float64, gcBins),
+		Buckets: make([]int, gcBins)}
+	for _, pts := range genomes {
+		mean := 0.0
+		for _, p := range pts {
+			mean += p.cnt
+		}
+		mean /= float64(len(pts))
+		if mean == 0 {
+			continue
+		}
+		for _, p := range pts {
+			sums[gcBin(p.gc)] += p.cnt / mean
+			c.Buckets[gcBin(p.gc)]++
+		}
+	}
+	fitted := false
+	for i := range sums {
+		if c.Buckets[i] >= minGCBuckets {
+			c.Coverage[i] = sums[i] / float64(c.Buckets[i])
+			fitted = true
+		} else {
+			c.Coverage[i] = math.NaN()
+		}
+	}
+	if !fitted {
+		return nil
+	}
+	fillGaps(c.Coverage)
+	return c
+}
+
+// Replaces NaNs with the value of the nearest non-NaN element.
+// Ties go to the lower element. a should have at least one non-NaN.
+func fillGaps(a []float64) {
+	orig := append([]float64(nil), a...)
+	for i := range a {
+		if !math.IsNaN(a[i]) {
+			continue
+		}
+		for d := 1; ; d++ {
+			if i-d >= 0 && !math.IsNaN(orig[i-d]) {
+				a[i] = orig[i-d]
+				break
+			}
+			if i+d < len(a) && !math.IsNaN(orig[i+d]) {
+				a[i] = orig[i+d]
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package abundance
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fluhus/gostuff/aio"
+)
+
+// Params are the tunable parameters of the estimation.
+type Params struct {
+	QualThresh     int     `json:"qualThresh"`     // Quality threshold for first pass.
+	QualThresh2    int     `json:"qualThresh2"`    // Quality threshold for second pass.
+	DenseSumRatio  int     `json:"denseSumRatio"`  // Dense sum ratio for first pass.
+	DenseSumRatio2 int     `json:"denseSumRatio2"` // Dense sum ratio for second pass.
+	MinNZ          float64 `json:"minNZ"`          // Minimal coverage for first pass.
+	MinNZ2         float64 `json:"minNZ2"`         // Minimal coverage for second pass.
+	MaxBinomialErr float64 `json:"maxBinomialErr"` // Disqualify genomes with this binomial error. 0 means no filtering.
+	GCCorrect      bool    `json:"gcCorrect"`      // Correct bucket counts for GC bias in the second pass.
+}
+
+// DefaultParams returns the default estimation parameters.
+func DefaultParams() Params {
+	return Params{
+		QualThresh:     30,
+		QualThresh2:    2,
+		DenseSumRatio:  20,
+		DenseSumRatio2: 20,
+		MinNZ:          0.01,
+		MinNZ2:         0.66,
+		MaxBinomialErr: 0.05,
+	}
+}
+
+// Validate returns an error if any of the parameters is out of range.
+func (p *Params) Validate() error {
+	if p.QualThresh < 0 || p.QualThresh > 255 {
+		return fmt.Errorf("qualThresh should be within 0-255, got %v",
+			p.QualThresh)
+	}
+	if p.QualThresh2 < 0 || p.QualThresh2 > 255 {
+		return fmt.Errorf("qualThresh2 should be within 0-255, got %v",
+			p.QualThresh2)
+	}
+	if p.DenseSumRatio < 0 {
+		return fmt.Errorf("denseSumRatio should be non-negative, got %v",
+			p.DenseSumRatio)
+	}
+	if p.DenseSumRatio2 < 0 {
+		return fmt.Errorf("denseSumRatio2 should be non-negative, got %v",
+			p.DenseSumRatio2)
+	}
+	if p.MinNZ < 0 || p.MinNZ > 1 {
+		return fmt.Errorf("minNZ should be within 0-1, got %v", p.MinNZ)
+	}
+	if p.MinNZ2 < 0 || p.MinNZ2 > 1 {
+		return fmt.Errorf("minNZ2 should be within 0-1, got %v", p.MinNZ2)
+	}
+	if p.MaxBinomialErr < 0 {
+		return fmt.Errorf("maxBinomialErr should be non-negative, got %v",
+			p.MaxBinomialErr)
+	}
+	return nil
+}
+
+// ReadParams reads parameters from a JSON file into p.
+// Fields that are missing from the file keep their values in p.
+// Unknown fields are an error.
+func ReadParams(file string, p *Params) error {
+	f, err := aio.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return fmt.Errorf("reading %v: %w", file, err)
+	}
+	return nil
+}
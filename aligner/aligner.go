@@ -0,0 +1,75 @@
+// Package aligner provides a common interface over short read aligners.
+package aligner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/bowtie"
+	"github.com/fluhus/bundy/common"
+	"github.com/fluhus/bundy/minimap"
+	"github.com/fluhus/bundy/samfile"
+)
+
+// Names of the supported aligners.
+const (
+	Bowtie2  = "bowtie2"
+	Minimap2 = "minimap2"
+)
+
+// An Aligner maps reads to a reference and returns real-time iterators over
+// the resulting SAM lines. The aligner process is killed if the context is
+// canceled or if iteration stops early.
+//
+// Aligners keep the header of their last run, so they are not safe for
+// concurrent runs. Use a separate aligner for each concurrent run.
+type Aligner interface {
+	// Map maps single-end reads from the given fastq file.
+	Map(ctx context.Context, fq string) iter.Seq2[*sam.SAM, error]
+
+	// Map2 maps paired-end reads from the given fastq files.
+	Map2(ctx context.Context, fq1, fq2 string) iter.Seq2[*sam.SAM, error]
+
+	// MapInt maps interleaved paired-end reads from the given fastq file.
+	MapInt(ctx context.Context, fq string) iter.Seq2[*sam.SAM, error]
+
+	// MapReader maps single-end reads from the given fastq stream.
+	MapReader(ctx context.Context, fq io.Reader) iter.Seq2[*sam.SAM, error]
+
+	// MapIntReader maps interleaved paired-end reads from the given fastq
+	// stream.
+	MapIntReader(ctx context.Context, fq io.Reader,
+	) iter.Seq2[*sam.SAM, error]
+
+	// MapKmers maps the k-mers of the sequences in the given fasta stream,
+	// taken every step positions. Read names are "sequence-name_offset".
+	MapKmers(ctx context.Context, fa io.Reader, k, step int,
+	) iter.Seq2[*sam.SAM, error]
+
+	// Header returns the SAM header of the last run.
+	// Available once iteration has started.
+	Header() *samfile.Header
+}
+
+// New returns the aligner with the given name, over the given reference
+// index. If fast is true, the aligner trades accuracy for speed. Fast mode
+// is supported only by bowtie2.
+func New(name, ref string, threads int, fast bool) (Aligner, error) {
+	switch name {
+	case Bowtie2:
+		return &bowtie.Bowtie{Ref: ref, Threads: threads,
+			Args: common.If(fast, []string{"--very-fast"}, nil)}, nil
+	case Minimap2:
+		if fast {
+			return nil, fmt.Errorf("fast mode is not supported with %s",
+				Minimap2)
+		}
+		return &minimap.Minimap{Ref: ref, Threads: threads}, nil
+	default:
+		return nil, fmt.Errorf("unsupported aligner: %q, want %q or %q",
+			name, Bowtie2, Minimap2)
+	}
+}
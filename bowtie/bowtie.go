@@ -2,137 +2,145 @@
 package bowtie
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"iter"
-	"os/exec"
 
 	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/samfile"
+	"github.com/fluhus/bundy/sampipe"
 )
 
 const (
 	exe = "bowtie2"
 )
 
+// Bowtie runs bowtie2 with a fixed reference and settings.
+//
+// A Bowtie keeps the header and summary of its last run, so it is not safe
+// for concurrent runs. Use a separate instance for each concurrent run.
+type Bowtie struct {
+	Ref     string   // Bowtie2 index.
+	Threads int      // Number of threads.
+	Args    []string // Additional arguments to bowtie2.
+
+	header *samfile.Header
+	stats  *Stats
+}
+
+// Header returns the SAM header of the last run.
+// Available once iteration has started.
+func (b *Bowtie) Header() *samfile.Header {
+	return b.header
+}
+
+// Stats returns the alignment summary of the last run.
+// Available once iteration has finished successfully.
+func (b *Bowtie) Stats() *Stats {
+	return b.stats
+}
+
+// Stores the header of the current run.
+func (b *Bowtie) setHeader(h *samfile.Header) {
+	b.header = h
+	b.stats = nil
+}
+
+// Stores the alignment summary of the current run.
+func (b *Bowtie) setStats(stderr []byte) {
+	b.stats, _ = ParseStats(stderr)
+}
+
+// Map runs bowtie on the given fastq file.
+func (b *Bowtie) Map(ctx context.Context, fq string,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, nil, mapArgs(b.Ref, b.Threads, b.Args, "-U", fq),
+		b.setHeader, b.setStats)
+}
+
+// Map2 runs bowtie on the given paired-end fastq files.
+func (b *Bowtie) Map2(ctx context.Context, fq1, fq2 string,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, nil,
+		mapArgs(b.Ref, b.Threads, b.Args, "-1", fq1, "-2", fq2), b.setHeader, b.setStats)
+}
+
+// MapInt runs bowtie on the given interleaved pairs fastq file.
+func (b *Bowtie) MapInt(ctx context.Context, fq string,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, nil,
+		mapArgs(b.Ref, b.Threads, b.Args, "--interleaved", fq), b.setHeader, b.setStats)
+}
+
+// MapReader runs bowtie on the given fastq stream.
+func (b *Bowtie) MapReader(ctx context.Context, fq io.Reader,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, fq, mapArgs(b.Ref, b.Threads, b.Args, "-U", "-"),
+		b.setHeader, b.setStats)
+}
+
+// MapIntReader runs bowtie on the given interleaved pairs fastq stream.
+func (b *Bowtie) MapIntReader(ctx context.Context, fq io.Reader,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, fq, mapArgs(b.Ref, b.Threads, b.Args, "--interleaved", "-"),
+		b.setHeader, b.setStats)
+}
+
+// MapKmers runs bowtie on the k-mers of the given fasta stream,
+// using bowtie's -F option.
+func (b *Bowtie) MapKmers(ctx context.Context, fa io.Reader, k, step int,
+) iter.Seq2[*sam.SAM, error] {
+	args := append([]string{"-F", fmt.Sprintf("%d,%d", k, step)}, b.Args...)
+	return run(ctx, fa, mapArgs(b.Ref, b.Threads, args, "-U", "-"),
+		b.setHeader, b.setStats)
+}
+
 // Map runs bowtie on the given fastq file and returns a real-time iterator
 // over the resulting SAM lines.
-func Map(fq, ref string, threads int, args ...string) iter.Seq2[*sam.SAM, error] {
-	return func(yield func(*sam.SAM, error) bool) {
-		allArgs := []string{
-			"-t", "--no-head", "-p", fmt.Sprint(threads),
-			"-x", ref, "-U", fq}
-		cmd := exec.Command(exe, append(allArgs, args...)...)
-		stderr := bytes.NewBuffer(nil)
-		cmd.Stderr = stderr
-		r, _ := cmd.StdoutPipe()
-		c := make(chan error, 1)
-		go func() {
-			err := cmd.Run()
-			if err != nil {
-				err = fmt.Errorf("%w\n%s", err, stderr.Bytes())
-			}
-			c <- err
-		}()
-		for sm, err := range sam.Reader(r) {
-			if !yield(sm, err) {
-				return
-			}
-		}
-		if err := <-c; err != nil {
-			yield(nil, err)
-		}
-	}
+func Map(ctx context.Context, fq, ref string, threads int, args ...string,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, nil, mapArgs(ref, threads, args, "-U", fq), nil, nil)
 }
 
 // MapInt runs bowtie on the given interleaved pairs fastq file
 // and returns a real-time iterator over the resulting SAM lines.
-func MapInt(fq, ref string, threads int, args ...string) iter.Seq2[*sam.SAM, error] {
-	return func(yield func(*sam.SAM, error) bool) {
-		allArgs := []string{
-			"-t", "--no-head", "-p", fmt.Sprint(threads),
-			"-x", ref, "--interleaved", fq}
-		cmd := exec.Command(exe, append(allArgs, args...)...)
-		stderr := bytes.NewBuffer(nil)
-		cmd.Stderr = stderr
-		r, _ := cmd.StdoutPipe()
-		c := make(chan error, 1)
-		go func() {
-			err := cmd.Run()
-			if err != nil {
-				err = fmt.Errorf("%w\n%s", err, stderr.Bytes())
-			}
-			c <- err
-		}()
-		for sm, err := range sam.Reader(r) {
-			if !yield(sm, err) {
-				return
-			}
-		}
-		if err := <-c; err != nil {
-			yield(nil, err)
-		}
-	}
+func MapInt(ctx context.Context, fq, ref string, threads int, args ...string,
+) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, nil, mapArgs(ref, threads, args, "--interleaved", fq),
+		nil, nil)
 }
 
 // Map2 runs bowtie on the given paired-end fastq files and returns a real-time
 // iterator over the resulting SAM lines.
-func Map2(fq1, fq2, ref string, threads int, args ...string) iter.Seq2[*sam.SAM, error] {
-	return func(yield func(*sam.SAM, error) bool) {
-		allArgs := []string{
-			"-t", "--no-head", "-p", fmt.Sprint(threads),
-			"-x", ref, "-1", fq1, "-2", fq2}
-		cmd := exec.Command(exe, append(allArgs, args...)...)
-		stderr := bytes.NewBuffer(nil)
-		cmd.Stderr = stderr
-		r, _ := cmd.StdoutPipe()
-		c := make(chan error, 1)
-		go func() {
-			err := cmd.Run()
-			if err != nil {
-				err = fmt.Errorf("%w\n%s", err, stderr.Bytes())
-			}
-			c <- err
-		}()
-		for sm, err := range sam.Reader(r) {
-			if !yield(sm, err) {
-				return
-			}
-		}
-		if err := <-c; err != nil {
-			yield(nil, err)
-		}
-	}
+func Map2(ctx context.Context, fq1, fq2, ref string, threads int,
+	args ...string) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, nil, mapArgs(ref, threads, args, "-1", fq1, "-2", fq2),
+		nil, nil)
 }
 
 // MapReader runs bowtie on the given fastq stream
 // and returns a real-time iterator over the resulting SAM lines.
-func MapReader(fq io.Reader, ref string, threads int, args ...string,
+func MapReader(ctx context.Context, fq io.Reader, ref string, threads int,
+	args ...string) iter.Seq2[*sam.SAM, error] {
+	return run(ctx, fq, mapArgs(ref, threads, args, "-U", "-"), nil, nil)
+}
+
+// Returns the full argument list for bowtie.
+func mapArgs(ref string, threads int, args []string, in ...string) []string {
+	all := []string{"-t", "-p", fmt.Sprint(threads), "-x", ref}
+	all = append(all, in...)
+	return append(all, args...)
+}
+
+// Runs bowtie with the given arguments and returns a real-time iterator
+// over the resulting SAM lines. Stdin may be nil. If onHeader is non-nil,
+// it is called with the SAM header before the first line is yielded.
+// If onStderr is non-nil, it is called with bowtie's stderr output once it
+// exits successfully. The bowtie process is killed if ctx is canceled or if
+// iteration stops early.
+func run(ctx context.Context, stdin io.Reader, args []string,
+	onHeader func(*samfile.Header), onStderr func([]byte),
 ) iter.Seq2[*sam.SAM, error] {
-	return func(yield func(*sam.SAM, error) bool) {
-		allArgs := []string{
-			"-t", "--no-head", "-p", fmt.Sprint(threads),
-			"-x", ref, "-U", "-"}
-		cmd := exec.Command(exe, append(allArgs, args...)...)
-		stderr := bytes.NewBuffer(nil)
-		cmd.Stderr = stderr
-		cmd.Stdin = fq
-		r, _ := cmd.StdoutPipe()
-		c := make(chan error, 1)
-		go func() {
-			err := cmd.Run()
-			if err != nil {
-				err = fmt.Errorf("%w\n%s", err, stderr.Bytes())
-			}
-			c <- err
-		}()
-		for sm, err := range sam.Reader(r) {
-			if !yield(sm, err) {
-				return
-			}
-		}
-		if err := <-c; err != nil {
-			yield(nil, err)
-		}
-	}
+	return sampipe.Run(ctx, exe, args, stdin, onHeader, onStderr)
 }
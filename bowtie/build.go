@@ -0,0 +1,62 @@
+package bowtie
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/bundy/sampipe"
+)
+
+const (
+	buildExe = "bowtie2-build"
+
+	// References longer than this need a large (64-bit) index.
+	largeIndexThresh = math.MaxUint32 - 200
+)
+
+// BuildIndex runs bowtie2-build on the given fasta files, creating an index
+// with the given prefix. Uses a large index if the reference is too long for
+// a small one.
+func BuildIndex(ctx context.Context, fastas []string, ref string,
+	threads int, args ...string) error {
+	if len(fastas) == 0 {
+		return fmt.Errorf("no fasta files to index")
+	}
+	n, err := totalLength(fastas)
+	if err != nil {
+		return err
+	}
+	all := []string{"--threads", fmt.Sprint(threads)}
+	if n > largeIndexThresh {
+		all = append(all, "--large-index")
+	}
+	all = append(all, args...)
+	all = append(all, strings.Join(fastas, ","), ref)
+
+	cmd := sampipe.Command(ctx, buildExe, all...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %w\n%s", buildExe, err, out)
+	}
+	return nil
+}
+
+// Returns the total length of the sequences in the given fasta files.
+func totalLength(files []string) (int, error) {
+	n := 0
+	for _, f := range files {
+		for fa, err := range fasta.File(f) {
+			if err != nil {
+				return 0, err
+			}
+			n += len(fa.Sequence)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,39 @@
+package bowtie
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/fluhus/bundy/sampipe"
+)
+
+const inspectExe = "bowtie2-inspect"
+
+// ExtractFasta writes the reference sequences stored in the given bowtie2
+// index to a fasta file, using bowtie2-inspect. The file is written to a
+// temporary file first, so it is either absent or complete.
+func ExtractFasta(ctx context.Context, ref, file string) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", file, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	cmd := sampipe.Command(ctx, inspectExe, ref)
+	cmd.Stdout = f
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %w\n%s", inspectExe, err, stderr.Bytes())
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,116 @@
+package bowtie
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Stats is the alignment summary that bowtie2 prints at the end of a run.
+type Stats struct {
+	Reads int `json:"reads"` // Input reads or pairs.
+
+	Unpaired               int `json:"unpaired"`               // Unpaired reads.
+	UnpairedAligned0       int `json:"unpairedAligned0"`       // Unpaired reads that aligned 0 times.
+	UnpairedAligned1       int `json:"unpairedAligned1"`       // Unpaired reads that aligned exactly once.
+	UnpairedAlignedMulti   int `json:"unpairedAlignedMulti"`   // Unpaired reads that aligned more than once.
+	Paired                 int `json:"paired"`                 // Read pairs.
+	ConcordantAligned0     int `json:"concordantAligned0"`     // Pairs that aligned concordantly 0 times.
+	ConcordantAligned1     int `json:"concordantAligned1"`     // Pairs that aligned concordantly exactly once.
+	ConcordantAlignedMulti int `json:"concordantAlignedMulti"` // Pairs that aligned concordantly more than once.
+	DiscordantAligned1     int `json:"discordantAligned1"`     // Pairs that aligned discordantly once.
+	Mates                  int `json:"mates"`                  // Mates of pairs that did not align as pairs.
+	MatesAligned0          int `json:"matesAligned0"`          // Such mates that aligned 0 times.
+	MatesAligned1          int `json:"matesAligned1"`          // Such mates that aligned exactly once.
+	MatesAlignedMulti      int `json:"matesAlignedMulti"`      // Such mates that aligned more than once.
+
+	OverallRate float64 `json:"overallRate"` // Overall alignment rate, in %.
+
+	// Timings reported with -t, in seconds, by their label
+	// (e.g. "Overall time").
+	Times map[string]float64 `json:"times,omitempty"`
+}
+
+var (
+	statsCountRE = regexp.MustCompile(`^\s*(\d+) (?:\([\d.]+%\) )?(.*)$`)
+	statsRateRE  = regexp.MustCompile(`^([\d.]+)% overall alignment rate$`)
+	statsTimeRE  = regexp.MustCompile(`^(.*): (\d+):(\d\d):(\d\d)$`)
+)
+
+// ParseStats parses bowtie2's alignment summary out of its stderr output.
+// Unrecognized lines are ignored.
+func ParseStats(stderr []byte) (*Stats, error) {
+	st := &Stats{}
+	found := false
+	var section *[3]*int // Counts for 0, 1 and >1 alignments.
+	sc := bufio.NewScanner(bytes.NewReader(stderr))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if m := statsRateRE.FindStringSubmatch(line); m != nil {
+			rate, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad alignment rate: %q", line)
+			}
+			st.OverallRate = rate
+			found = true
+			continue
+		}
+		if m := statsTimeRE.FindStringSubmatch(line); m != nil {
+			h, _ := strconv.Atoi(m[2])
+			mi, _ := strconv.Atoi(m[3])
+			s, _ := strconv.Atoi(m[4])
+			if st.Times == nil {
+				st.Times = map[string]float64{}
+			}
+			st.Times[m[1]] = float64(h*3600 + mi*60 + s)
+			continue
+		}
+		m := statsCountRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad count: %q", line)
+		}
+		switch text := m[2]; text {
+		case "reads; of these:":
+			st.Reads = n
+		case "were unpaired; of these:":
+			st.Unpaired = n
+			section = &[3]*int{&st.UnpairedAligned0, &st.UnpairedAligned1,
+				&st.UnpairedAlignedMulti}
+		case "were paired; of these:":
+			st.Paired = n
+		case "aligned concordantly 0 times":
+			st.ConcordantAligned0 = n
+		case "aligned concordantly exactly 1 time":
+			st.ConcordantAligned1 = n
+		case "aligned concordantly >1 times":
+			st.ConcordantAlignedMulti = n
+		case "aligned discordantly 1 time":
+			st.DiscordantAligned1 = n
+		case "mates make up the pairs; of these:":
+			st.Mates = n
+			section = &[3]*int{&st.MatesAligned0, &st.MatesAligned1,
+				&st.MatesAlignedMulti}
+		case "aligned 0 times", "aligned exactly 1 time", "aligned >1 times":
+			if section == nil {
+				continue
+			}
+			i := map[string]int{"aligned 0 times": 0,
+				"aligned exactly 1 time": 1, "aligned >1 times": 2}[text]
+			*section[i] = n
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no alignment summary found")
+	}
+	return st, nil
+}
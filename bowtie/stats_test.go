@@ -0,0 +1,43 @@
+package bowtie
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStats(t *testing.T) {
+	input := "Time loading reference: 00:00:01\n" +
+		"Multiseed full-index search: 00:01:02\n" +
+		"10000 reads; of these:\n" +
+		"  10000 (100.00%) were paired; of these:\n" +
+		"    650 (6.50%) aligned concordantly 0 times\n" +
+		"    8823 (88.23%) aligned concordantly exactly 1 time\n" +
+		"    527 (5.27%) aligned concordantly >1 times\n" +
+		"    ----\n" +
+		"    650 pairs aligned concordantly 0 times; of these:\n" +
+		"      34 (5.23%) aligned discordantly 1 time\n" +
+		"    ----\n" +
+		"    616 pairs aligned 0 times concordantly or discordantly; of these:\n" +
+		"      1232 mates make up the pairs; of these:\n" +
+		"        660 (53.57%) aligned 0 times\n" +
+		"        571 (46.35%) aligned exactly 1 time\n" +
+		"        1 (0.08%) aligned >1 times\n" +
+		"96.70% overall alignment rate\n" +
+		"Overall time: 01:00:03\n"
+	want := &Stats{
+		Reads: 10000, Paired: 10000,
+		ConcordantAligned0: 650, ConcordantAligned1: 8823,
+		ConcordantAlignedMulti: 527, DiscordantAligned1: 34,
+		Mates: 1232, MatesAligned0: 660, MatesAligned1: 571,
+		MatesAlignedMulti: 1, OverallRate: 96.7,
+		Times: map[string]float64{"Time loading reference": 1,
+			"Multiseed full-index search": 62, "Overall time": 3603},
+	}
+	got, err := ParseStats([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseStats(...) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseStats(...)=%+v, want %+v", got, want)
+	}
+}
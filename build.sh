@@ -5,15 +5,15 @@ rm -fr build
 mkdir build
 
 # Linux
-go build -o build ./bundy ./bundyx
-zip -j build/bundy_linux_amd64.zip build/bundy build/bundyx
+go build -o build ./bundy ./bundyx ./bundyb ./bxconvert ./bxmerge ./bundymerge
+zip -j build/bundy_linux_amd64.zip build/bundy build/bundyx build/bundyb build/bxconvert build/bxmerge build/bundymerge
 
 # Mac
-GOOS=darwin GOARCH=arm64 go build -o build ./bundy ./bundyx
-zip -j build/bundy_macos_arm64.zip build/bundy build/bundyx
+GOOS=darwin GOARCH=arm64 go build -o build ./bundy ./bundyx ./bundyb ./bxconvert ./bxmerge ./bundymerge
+zip -j build/bundy_macos_arm64.zip build/bundy build/bundyx build/bundyb build/bxconvert build/bxmerge build/bundymerge
 
 # Windows
-GOOS=windows go build -o build ./bundy ./bundyx
-zip -j build/bundy_win_amd64.zip build/bundy.exe build/bundyx.exe
+GOOS=windows go build -o build ./bundy ./bundyx ./bundyb ./bxconvert ./bxmerge ./bundymerge
+zip -j build/bundy_win_amd64.zip build/bundy.exe build/bundyx.exe build/bundyb.exe build/bxconvert.exe build/bxmerge.exe build/bundymerge.exe
 
-rm build/bundy build/bundyx build/bundy.exe build/bundyx.exe
+rm build/bundy build/bundyx build/bundyb build/bxconvert build/bxmerge build/bundymerge build/bundy.exe build/bundyx.exe build/bundyb.exe build/bxconvert.exe build/bxmerge.exe build/bundymerge.exe
@@ -0,0 +1,236 @@
+// Batch mode: runs many samples with the bundyx data loaded once.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fluhus/bundy/abundance"
+	"github.com/fluhus/bundy/aligner"
+	"github.com/fluhus/bundy/table"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/sets"
+)
+
+// Name of the combined abundance matrix in the output directory.
+const matrixFile = "matrix.tsv"
+
+// Checks the arguments for batch mode.
+func checkBatchArgs() error {
+	if *inFile != "" || *inFile2 != "" || *inSAM != "" || *interleaved {
+		return fmt.Errorf("input flags (-i, -i2, -sam, -interleaved) " +
+			"cannot be used with -batch")
+	}
+	if *usedFile != "" || *unusedFile != "" || *usedSAMFile != "" ||
+		*unusedSAMFile != "" {
+		return fmt.Errorf("used/unused dumps cannot be used with -batch")
+	}
+	if *outFile == "" {
+		return fmt.Errorf("no output directory")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("bad number of workers (-w): %d", *workers)
+	}
+	return nil
+}
+
+// Reads a sample sheet. Each line has tab-separated sample name, first
+// fastq, and optionally second fastq and whether the first fastq is
+// interleaved. Empty lines and comments (#) are skipped, and so is the first
+// remaining line if it starts with "sample", as a header.
+func readSheet(file string) ([]*sample, error) {
+	f, err := aio.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var samples []*sample
+	names := sets.Set[string]{}
+	sc := bufio.NewScanner(f)
+	first := true
+	for i := 1; sc.Scan(); i++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		header := first && fields[0] == "sample"
+		first = false
+		if header {
+			continue
+		}
+		s, err := parseSheetLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", file, i, err)
+		}
+		if names.Has(s.name) {
+			return nil, fmt.Errorf("%s: line %d: duplicate sample: %q",
+				file, i, s.name)
+		}
+		names.Add(s.name)
+		samples = append(samples, s)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("%s: no samples", file)
+	}
+	return samples, nil
+}
+
+// Parses the fields of a single sample sheet line.
+func parseSheetLine(fields []string) (*sample, error) {
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("got %d fields, want 2-4", len(fields))
+	}
+	s := &sample{name: fields[0], in1: fields[1]}
+	if s.name == "" || strings.ContainsAny(s.name, `/\`) {
+		return nil, fmt.Errorf("bad sample name: %q", s.name)
+	}
+	if s.in1 == "" {
+		return nil, fmt.Errorf("no input file for sample %q", s.name)
+	}
+	if len(fields) > 2 && fields[2] != "-" {
+		s.in2 = fields[2]
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		var err error
+		if s.interleaved, err = strconv.ParseBool(fields[3]); err != nil {
+			return nil, fmt.Errorf("bad interleaved value: %q", fields[3])
+		}
+	}
+	if s.in2 != "" && s.interleaved {
+		return nil, fmt.Errorf("sample %q has a second file but is "+
+			"interleaved", s.name)
+	}
+	return s, nil
+}
+
+// Runs all the samples in the sample sheet, and writes the combined matrix.
+// Samples whose outputs exist are skipped.
+func runBatch(ctx context.Context, ref *refData) error {
+	samples, err := readSheet(*batchFile)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outFile, 0o755); err != nil {
+		return err
+	}
+	ext := ".tsv"
+	if *toJSON {
+		ext = ".json"
+	}
+	var todo []*sample
+	for _, s := range samples {
+		s.out = filepath.Join(*outFile, s.name+ext)
+		s.qc = filepath.Join(*outFile, s.name+".qc.json")
+		if _, err := os.Stat(s.out); err == nil {
+			fmt.Fprintf(os.Stderr, "Sample %s already done\n", s.name)
+			continue
+		}
+		todo = append(todo, s)
+	}
+	fmt.Fprintf(os.Stderr, "Running %d of %d samples (%d in parallel)\n",
+		len(todo), len(samples), *workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan *sample)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for range min(*workers, len(todo)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				if err := runBatchSample(ctx, s, ref); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("sample %s: %w", s.name, err)
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "Sample %s done\n", s.name)
+			}
+		}()
+	}
+loop:
+	for _, s := range todo {
+		select {
+		case jobs <- s:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Writing matrix")
+	var names []string
+	var tables []map[string]*abundance.GenomeStats
+	for _, s := range samples {
+		t, err := table.Read(s.out)
+		if err != nil {
+			return err
+		}
+		names = append(names, s.name)
+		tables = append(tables, t)
+	}
+	file := filepath.Join(*outFile, matrixFile)
+	m := table.NewMatrix(names, tables,
+		func(g *abundance.GenomeStats) float64 { return g.Abundance })
+	if err := m.WriteWide(file, "0"); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Wrote matrix to:", file)
+	return nil
+}
+
+// Runs a single sample with its own aligner. The output is written to a
+// temporary file first, so that an interrupted sample is not skipped when
+// resuming.
+func runBatchSample(ctx context.Context, s *sample, ref *refData) error {
+	fmt.Fprintf(os.Stderr, "Sample %s: %s\n", s.name,
+		strings.Join([]string{s.in1, s.in2}, " "))
+	if _, err := os.Stat(s.in1); err != nil {
+		return fmt.Errorf("unable to access input file: %w", err)
+	}
+	al, err := aligner.New(*alignerName, *refFile, *threads, *fast)
+	if err != nil {
+		return err
+	}
+	ss := *s
+	ss.out = s.out + ".tmp"
+	ss.store = newSamStore("")
+	if *diskMode != "" {
+		ss.store = newSamStore(sampleFile(*diskMode, s.name))
+	}
+	if _, err := runSample(ctx, &ss, al, ref); err != nil {
+		os.Remove(ss.out)
+		return err
+	}
+	return os.Rename(ss.out, s.out)
+}
+
+// Adds the sample name to the given file name, before its extension.
+func sampleFile(file, name string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + name + ext
+}
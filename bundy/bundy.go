@@ -3,64 +3,55 @@ package main
 
 import (
 	"cmp"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"iter"
-	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
-	"sort"
-	"strings"
+	"slices"
 
 	"github.com/fluhus/biostuff/formats/fastq"
 	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/abundance"
+	"github.com/fluhus/bundy/aligner"
 	"github.com/fluhus/bundy/bowtie"
+	"github.com/fluhus/bundy/bxdb"
 	"github.com/fluhus/bundy/common"
+	"github.com/fluhus/bundy/mask"
+	"github.com/fluhus/bundy/samfile"
+	"github.com/fluhus/bundy/table"
 	"github.com/fluhus/gostuff/aio"
 	"github.com/fluhus/gostuff/gnum"
 	"github.com/fluhus/gostuff/jio"
 	"github.com/fluhus/gostuff/ptimer"
-	"github.com/fluhus/gostuff/sets"
 	"github.com/fluhus/gostuff/snm"
 	"golang.org/x/exp/maps"
 )
 
-const (
-	qualThresh     = 30   // Quality threshold for first pass.
-	qualThresh2    = 2    // Quality threshold for second pass.
-	denseSumRatio  = 20   // Dense sum ratio for first pass.
-	denseSumRatio2 = 20   // Dense sum ratio for second pass.
-	minNZ          = 0.01 // Minimal coverage for first pass.
-	minNZ2         = 0.66 // Minimal coverage for second pass.
-	maxBinomialErr = 0.05 // Disqualify buckets with this binomial error.
-)
-
 // Debug stuff.
 const (
-	printConsts     = false
-	printCumQuals   = false
-	denseSumNonZero = false
-	printSpecies    = ""
-	printWhiteList  = false
-	assertNZNonNeg  = true
-	printRawCounts  = false
-	printNReads     = true
+	printCumQuals  = false
+	printWhiteList = false
+	printNReads    = true
 )
 
 var (
 	inFile        = flag.String("i", "", "Input fastq file")
 	inFile2       = flag.String("i2", "", "Second input fastq file for paired-end")
-	outFile       = flag.String("o", "", "Output TSV file")
-	refFile       = flag.String("x", "", "Bowtie reference")
+	inSAM         = flag.String("sam", "", "Input SAM/BAM file of reads that are already aligned to the reference, instead of -i (- for stdin)")
+	outFile       = flag.String("o", "", "Output TSV file (output directory with -batch)")
+	refFile       = flag.String("x", "", "Aligner reference (bowtie2 index, or minimap2 index or fasta)")
+	alignerName   = flag.String("a", aligner.Bowtie2, "Aligner to use: bowtie2 or minimap2")
 	usedFile      = flag.String("u", "", "Print USED reads to this fastq")
 	unusedFile    = flag.String("uu", "", "Print UNUSED reads to this fastq")
-	usedSAMFile   = flag.String("us", "", "Print USED reads to this SAM")
-	unusedSAMFile = flag.String("uus", "", "Print UNUSED reads to this SAM")
-	oksGlob       = flag.String("bx", "", "Bundyx data files glob (default: bowtie_reference.bx/*)")
-	threads       = flag.Int("t", 1, "Number of bowtie2 threads")
+	usedSAMFile   = flag.String("us", "", "Print USED reads to this SAM (BAM if ends with .bam)")
+	unusedSAMFile = flag.String("uus", "", "Print UNUSED reads to this SAM (BAM if ends with .bam)")
+	oksGlob       = flag.String("bx", "", "Bundyx data files glob (default: bowtie_reference.bxdb if exists, else bowtie_reference.bx/*)")
+	threads       = flag.Int("t", 1, "Number of aligner threads")
 	toJSON        = flag.Bool("j", false, "Output JSON instead of TSV")
 	namePat       = flag.String("n", ".*",
 		"Pattern by which to group contigs of the same species")
@@ -68,192 +59,82 @@ var (
 	ignoreLength = flag.Bool("ignlen", false, "Ignore genome lengths in normalization")
 	fast         = flag.Bool("fast", false, "Quick run, loses some accuracy")
 	interleaved  = flag.Bool("interleaved", false, "Input fasta has interleaved paired-end reads")
-	diskMode     = flag.String("diskmode", "", "Write intermediate data to a `directory` rather than to RAM")
-
-	speciesToPrint = createPrintSpeciesMap()
+	diskMode     = flag.String("diskmode", "", "Write intermediate data to this `file` rather than to RAM (BAM if ends with .bam)")
+	paramsFile   = flag.String("params", "", "Read estimation parameters from this JSON `file` (explicit flags take precedence)")
+	paramsOut    = flag.String("wp", "", "Write the estimation parameters to this JSON `file` (default: output file + .params.json)")
+	qcFile       = flag.String("qc", "", "Write quality control stats to this JSON `file`")
+	force        = flag.Bool("force", false, "Run even if the bundyx data was built from a different reference")
+	bootstrap    = flag.Int("boot", 0, "Number of bootstrap resamples for standard errors and confidence intervals (0 for none)")
+	bootSeed     = flag.Uint64("bootseed", 0, "Random seed for bootstrap")
+	batchFile    = flag.String("batch", "", "Run on the samples in this sample sheet `file`, writing to the output directory (-o)")
+	workers      = flag.Int("w", 1, "Number of samples to run in parallel in batch mode")
+	maskFile     = flag.String("mask", "", "BED `file` of regions to exclude from counting and from genome lengths")
+	params       = paramsFlags()
 )
 
 func main() {
-	if printConsts {
-		fmt.Fprintln(os.Stderr, "**********")
-		fmt.Fprintln(os.Stderr, "qualThresh", qualThresh, qualThresh2)
-		fmt.Fprintln(os.Stderr, "denseSumRatio", denseSumRatio, denseSumRatio2)
-		fmt.Fprintln(os.Stderr, "printCumQuals", printCumQuals)
-		fmt.Fprintln(os.Stderr, "denseSumNonZero", denseSumNonZero)
-		fmt.Fprintln(os.Stderr, "printSpecies", printSpecies)
-		fmt.Fprintln(os.Stderr, "minNZ", minNZ, minNZ2)
-		fmt.Fprintln(os.Stderr, "printWhiteList", printWhiteList)
-		fmt.Fprintln(os.Stderr, "maxBinomialErr", maxBinomialErr)
-		fmt.Fprintln(os.Stderr, "assertNZNonNeg", assertNZNonNeg)
-		fmt.Fprintln(os.Stderr, "**********")
-		fmt.Fprintln(os.Stderr)
-	}
-
 	flag.Parse()
 	debug.SetGCPercent(20)
+	ctx := common.SignalContext()
 
-	if *inFile == "" {
-		common.Die(fmt.Errorf("no input file"))
-	}
-	if *outFile == "" {
-		common.Die(fmt.Errorf("no output file"))
-	}
-	if _, err := os.Stat(*inFile); err != nil {
-		common.Die(fmt.Errorf("unable to access input file: %w", err))
-	}
+	common.Die(checkArgs())
 	if *oksGlob == "" {
+		if *refFile == "" {
+			common.Die(fmt.Errorf("no reference (-x) or bundyx data (-bx)"))
+		}
 		*oksGlob = filepath.Join(*refFile+".bx", "*")
+		if _, err := os.Stat(*refFile + ".bxdb"); err == nil {
+			*oksGlob = *refFile + ".bxdb" // Merged parts.
+		}
 	}
-	var err error
-	nameRE, err = regexp.Compile(*namePat)
+	nameRE, err := regexp.Compile(*namePat)
 	common.Die(err)
+	common.Die(loadParams())
+	if *paramsOut == "" && *batchFile == "" {
+		// Batch QC files record the parameters of each sample.
+		*paramsOut = *outFile + ".params.json"
+	}
+	if *paramsOut != "" {
+		common.Die(jio.Write(*paramsOut, params))
+	}
 
 	fmt.Fprintln(os.Stderr, "Running with:")
+	fmt.Fprintln(os.Stderr, "\tAligner:", *alignerName)
 	fmt.Fprintln(os.Stderr, "\tRef:\t", shortenString(*refFile, 70))
 	fmt.Fprintln(os.Stderr, "\tOKs:\t", shortenString(*oksGlob, 70))
 	fmt.Fprintln(os.Stderr, "\tRegex:\t", nameRE)
+	fmt.Fprintf(os.Stderr, "\tParams:\t %+v\n", *params)
 	fmt.Fprintln(os.Stderr)
 
 	fmt.Fprintln(os.Stderr, "Loading bundyx data")
 	pt := ptimer.New()
-	var entries map[string]*contigEntry
-	entries, err = loadBuckets()
+	ref := &refData{nameRE: nameRE}
+	ref.db, ref.dbh, err = abundance.Load(*oksGlob)
 	pt.Done()
 	common.Die(err)
-
-	fmt.Fprintln(os.Stderr, "Mapping")
-	all, unmapped, lowq := 0, 0, 0
-	pt = ptimer.NewMessage("Loading reference")
-	quals := map[int]int{}
-	samw, err := samWriter()
-	common.Die(err)
-
-	var sams iter.Seq2[*sam.SAM, error]
-	args := common.If(*fast, []string{"--very-fast"}, nil)
-	if *inFile2 == "" {
-		if *interleaved {
-			sams = bowtie.MapInt(*inFile, *refFile, *threads, args...)
-		} else {
-			sams = bowtie.Map(*inFile, *refFile, *threads, args...)
-		}
-	} else {
-		sams = bowtie.Map2(*inFile, *inFile2, *refFile, *threads, args...)
-	}
-
-	nreads := 0 // TODO(amit): Consider whether we need this.
-	for sm, err := range sams {
+	if *maskFile != "" {
+		ref.mask, err = mask.Load(*maskFile)
 		common.Die(err)
-		if pt.N == 0 {
-			pt.Done()
-			pt = ptimer.NewMessage("{} reads processed")
-			pt.Inc()
-		}
-		pt.Inc()
-
-		txt, _ := sm.MarshalText()
-		samw.Write(txt)
-
-		all++
-		if sm.Flag == sam.FlagUnmapped {
-			unmapped++
-			continue
-		}
-		quals[sm.Mapq]++
-		if sm.Mapq < qualThresh {
-			lowq++
-			continue
-		}
-
-		nreads++
-		entries[sm.Rname].addPos(sm.Pos)
-	}
-	pt.Done()
-	if printNReads {
-		fmt.Println("NReads:", nreads)
-	}
-	samw.Close()
-
-	fmt.Fprintf(os.Stderr, "Mapped OK %v | Low quality %v | Unmapped %v\n",
-		common.Percf(all-unmapped-lowq, all, 0),
-		common.Percf(lowq, all, 0),
-		common.Percf(unmapped, all, 0))
-
-	var wl sets.Set[string]
-	{ // TODO(amit): Make this a function?
-		wl = sets.FromKeys(
-			entriesToAbundances(entries, denseSumRatio, minNZ, 0))
-		fmt.Fprintln(os.Stderr, "Found", len(wl), "candidate genomes")
-		if printWhiteList {
-			fmt.Fprintln(os.Stderr, wl)
-		}
-		for _, e := range entries {
-			e.counts = nil
-		}
-
-		all, unmapped, lowq := 0, 0, 0
-		pt = ptimer.NewMessage("{} reads processed")
-		quals := map[int]int{}
-
-		nreads := 0 // TODO(amit): Consider whether we need this.
-		for sm, err := range samReader() {
-			common.Die(err)
-			pt.Inc()
-			all++
-			if sm.Flag == sam.FlagUnmapped {
-				unmapped++
-				continue
-			}
-			quals[sm.Mapq]++
-			if sm.Mapq < qualThresh2 {
-				lowq++
-				continue
-			}
-			nreads++
-			entries[sm.Rname].addPos(sm.Pos)
-		}
-		pt.Done()
-		if printNReads {
-			fmt.Println("NReads:", nreads)
-		}
-		fmt.Fprintf(os.Stderr, "Mapped OK %v | Low quality %v | Unmapped %v\n",
-			common.Percf(all-unmapped-lowq, all, 0),
-			common.Percf(lowq, all, 0),
-			common.Percf(unmapped, all, 0))
 	}
+	checkDBHeader(ref.dbh, ref.mask)
 
-	abnd := entriesToAbundances(entries, denseSumRatio2, minNZ2, maxBinomialErr)
-	if printRawCounts {
-		abnd = entriesToRawCounts(entries)
+	if *batchFile != "" {
+		common.Die(runBatch(ctx, ref))
+		fmt.Fprintln(os.Stderr, "Done")
+		return
 	}
-	abnd = snm.FilterMap(abnd, func(s string, f float64) bool {
-		return wl.Has(s)
-	})
-	if !printRawCounts {
-		toSum1(abnd)
-	}
-	fmt.Fprintln(os.Stderr, "Grouped to", len(abnd), "genomes")
 
-	fmt.Fprintln(os.Stderr, "Saving")
-	if *toJSON {
-		common.Die(jio.Write(*outFile, abnd))
-	} else {
-		of, err := aio.Create(*outFile)
-		common.Die(err)
-		keys := snm.SortedFunc(maps.Keys(abnd), func(a, b string) int {
-			return cmp.Compare(abnd[b], abnd[a])
-		})
-		for _, k := range keys {
-			if printRawCounts {
-				fmt.Fprintf(of, "%s\t%d\n", k, int(abnd[k]))
-			} else {
-				fmt.Fprintf(of, "%s\t%g\n", k, abnd[k])
-			}
-		}
-		of.Close()
-	}
+	al, err := aligner.New(*alignerName, *refFile, *threads, *fast)
+	common.Die(err)
+	s := &sample{in1: *inFile, in2: *inFile2, interleaved: *interleaved,
+		sam: *inSAM, out: *outFile, qc: *qcFile, store: newSamStore(*diskMode)}
+	res, err := runSample(ctx, s, al, ref)
+	common.Die(err)
+	st, est, header := res.first, res.est, res.header
 
 	// Debug stats printing.
 	if printCumQuals {
+		quals := st.Quals
 		cumquals := map[int]float64{}
 		keys := snm.Sorted(maps.Keys(quals))
 		sum := float64(gnum.Sum(maps.Values(quals)))
@@ -270,7 +151,8 @@ func main() {
 	// Dump used/unused reads.
 	if cmp.Or(*usedFile, *unusedFile, *usedSAMFile, *unusedSAMFile) != "" {
 		fmt.Fprintln(os.Stderr, "Dumping used/unused reads")
-		var uout, uuout, usout, uusout io.WriteCloser
+		var uout, uuout io.WriteCloser
+		var usout, uusout samfile.Writer
 		if *usedFile != "" {
 			uout, err = aio.Create(*usedFile)
 			common.Die(err)
@@ -280,28 +162,28 @@ func main() {
 			common.Die(err)
 		}
 		if *usedSAMFile != "" {
-			usout, err = aio.Create(*usedSAMFile)
+			usout, err = samfile.Create(*usedSAMFile, header())
 			common.Die(err)
 		}
 		if *unusedSAMFile != "" {
-			uusout, err = aio.Create(*unusedSAMFile)
+			uusout, err = samfile.Create(*unusedSAMFile, header())
 			common.Die(err)
 		}
 		nused := 0
 		pt = ptimer.NewMessage("{} reads processed")
 
-		for sm, err := range samReader() {
+		for sm, err := range s.store.reader() {
 			common.Die(err)
 			pt.Inc()
-			if !samMapped(sm) || sm.Mapq < qualThresh2 ||
-				abnd[nameRE.FindString(sm.Rname)] == 0 { // Unused.
+			if !abundance.IsPrimary(sm) {
+				continue
+			}
+			if !est.Used(sm) { // Unused.
 				if uuout != nil {
 					common.Die(writeSamAsFastq(sm, uuout))
 				}
 				if uusout != nil {
-					txt, _ := sm.MarshalText()
-					_, err := uusout.Write(txt)
-					common.Die(err)
+					common.Die(uusout.Write(sm))
 				}
 			} else { // Used.
 				nused++
@@ -309,230 +191,433 @@ func main() {
 					common.Die(writeSamAsFastq(sm, uout))
 				}
 				if usout != nil {
-					txt, _ := sm.MarshalText()
-					_, err := usout.Write(txt)
-					common.Die(err)
+					common.Die(usout.Write(sm))
 				}
 			}
 		}
 		pt.Done()
-		fmt.Fprintf(os.Stderr, "Used %v of the reads\n", common.Percf(nused, all, 1))
-		common.Die(closeAll(uout, uuout, usout, uusout))
+		fmt.Fprintf(os.Stderr, "Used %v of the reads\n", common.Percf(nused, st.All, 1))
+		common.Die(closeAll(uout, uuout))
+		common.Die(closeAll(usout, uusout))
 	}
 
 	fmt.Fprintln(os.Stderr, "Done")
 }
 
-var nameRE *regexp.Regexp
-
-// Returns the sum of a, discarding some outliers.
-func fDenseSum(a []float64, ratio int, nz float64) float64 {
-	if assertNZNonNeg && nz < 0 { // Debug assert.
-		panic(fmt.Sprintf("negative nz: %f", nz))
+// Checks the input and output arguments.
+func checkArgs() error {
+	if *bootstrap < 0 {
+		return fmt.Errorf("bad number of bootstrap resamples: %d", *bootstrap)
 	}
-	// No use for a window. For len=2 it will return the lower value.
-	if len(a) <= 1 {
-		return gnum.Sum(a)
+	if _, err := aligner.New(*alignerName, *refFile, *threads, *fast); err != nil {
+		return err
 	}
-
-	// Actual dense sum.
-	sort.Float64s(a)
-	if nz != 0 {
-		i := len(a) - 1 - iround(float64(len(a)-1)*nz)
-		if a[i] == 0 {
-			return 0 // Too many zeros.
-		}
+	if *batchFile != "" {
+		return checkBatchArgs()
 	}
-	n := len(a)
-	if denseSumNonZero {
-		a = snm.FilterSlice(a, func(f float64) bool { return f > 0 })
-		if len(a) <= 1 {
-			return gnum.Sum(a) * float64(n)
-		}
+	if *inFile == "" && *inSAM == "" {
+		return fmt.Errorf("no input file")
 	}
-
-	winlen := len(a)
-	if ratio > 1 {
-		winlen = gnum.Idiv(len(a)*(ratio-1), ratio)
-		if winlen == len(a) {
-			winlen--
-		}
+	if *inFile != "" && *inSAM != "" {
+		return fmt.Errorf("only one of -i and -sam may be given")
 	}
-
-	min, pos := math.Inf(1), 0
-	for i := range a[winlen-1:] { // We have winlen+1 windows.
-		diff := a[i+winlen-1] - a[i]
-		if diff < min {
-			min, pos = diff, i
+	if *outFile == "" {
+		return fmt.Errorf("no output file")
+	}
+	if *inFile != "" {
+		if _, err := os.Stat(*inFile); err != nil {
+			return fmt.Errorf("unable to access input file: %w", err)
 		}
 	}
-	return gnum.Sum(a[pos:pos+winlen]) * float64(n) / float64(winlen)
+	return nil
 }
 
-// Shortens a string for display.
-func shortenString(s string, n int) string {
-	if len(s) <= n {
-		return s
-	}
-	const filler = " ... "
-	pre := (n - len(filler)) / 2
-	suf := (n - len(filler) + 1) / 2
-	return s[:pre] + filler + s[len(s)-suf:]
+// Bundyx data shared by all samples.
+type refData struct {
+	db     map[string]*abundance.Contig
+	dbh    *bxdb.Header
+	mask   *mask.Mask
+	nameRE *regexp.Regexp
 }
 
-type contigEntry struct {
-	ok      int        // Total OK mappings.
-	all     int        // All positions.
-	buckets *bucketOKs // Per-bucket information.
-	counts  []int      // Mapping counts.
-	sum     float64    // Dense sum.
+// A single input sample and where to write its results.
+type sample struct {
+	name        string    // Sample name, for batch mode.
+	in1, in2    string    // Input fastq files, in2 for paired-end.
+	interleaved bool      // in1 has interleaved paired-end reads.
+	sam         string    // Pre-aligned input, instead of in1.
+	out         string    // Output table.
+	qc          string    // Output QC file, empty for none.
+	store       *samStore // Intermediate storage of alignments.
 }
 
-type bucketOKs struct {
-	pos []int // Boundries of buckets.
-	ok  []int // OK mappings per bucket.
+// Returns whether the sample's reads are paired-end.
+func (s *sample) paired() bool {
+	return s.in2 != "" || s.interleaved
 }
 
-// Adds one count to the bucket at the given position.
-func (e *contigEntry) addPos(pos int) {
-	if e.counts == nil {
-		e.counts = make([]int, len(e.buckets.ok))
-	}
-	bucket := sort.SearchInts(e.buckets.pos, pos)
-	e.counts[bucket]++
+// Results of a single sample, for post-processing.
+type sampleResult struct {
+	est     *abundance.Estimator
+	first   *abundance.PassStats   // First pass stats.
+	header  func() *samfile.Header // Header of the alignments.
+	genomes map[string]*abundance.GenomeStats
 }
 
-// Loads and returns bundyx buckets.
-func loadBuckets() (map[string]*contigEntry, error) {
-	type entry struct {
-		OK      int
-		All     int
-		Name    string
-		Buckets struct {
-			Buckets []int
-			OK      []int
+// Aligns and estimates the abundances of a single sample, and writes its
+// outputs.
+func runSample(ctx context.Context, s *sample, al aligner.Aligner,
+	ref *refData) (*sampleResult, error) {
+	if s.paired() && ref.dbh != nil && !slices.Contains(ref.dbh.Paired, true) {
+		fmt.Fprintln(os.Stderr, "WARNING: input is paired-end but bundyx "+
+			"data has no paired-end profiles, using single-end profiles")
+	}
+	est := abundance.NewEstimator(ref.db, &abundance.Options{
+		NamePattern:   ref.nameRE,
+		Params:        params,
+		IgnoreLength:  *ignoreLength,
+		Paired:        s.paired(),
+		ReadLens:      dbReadLens(ref.dbh),
+		ProfilePaired: dbPaired(ref.dbh),
+		Balanced:      ref.dbh != nil && ref.dbh.Balanced,
+		Mask:          ref.mask,
+		Bootstrap:     *bootstrap,
+		Seed:          *bootSeed,
+	})
+
+	var sams iter.Seq2[*sam.SAM, error]
+	header := al.Header
+	switch {
+	case s.sam != "":
+		fmt.Fprintln(os.Stderr, "Reading alignments")
+		sr, err := samfile.Open(s.sam)
+		if err != nil {
+			return nil, err
+		}
+		defer sr.Close()
+		sams = sr.Iter()
+		header = func() *samfile.Header { return sr.Header }
+	case s.in2 != "":
+		fmt.Fprintln(os.Stderr, "Mapping")
+		sams = al.Map2(ctx, s.in1, s.in2)
+	case s.interleaved:
+		fmt.Fprintln(os.Stderr, "Mapping")
+		sams = al.MapInt(ctx, s.in1)
+	default:
+		fmt.Fprintln(os.Stderr, "Mapping")
+		sams = al.Map(ctx, s.in1)
+	}
+
+	sams = withRefCheck(sams, header, ref.db, ref.dbh)
+	st, err := est.FirstPass(teeSams(sams, header, s.store))
+	if err != nil {
+		return nil, err
+	}
+	printPassStats(st)
+	if rl := dbReadLens(ref.dbh); len(rl) > 1 {
+		fmt.Fprintln(os.Stderr, "Read length profile weights:")
+		for i, w := range est.ProfileWeights() {
+			fmt.Fprintf(os.Stderr, "\t%d%s: %.2f\n", rl[i],
+				common.If(ref.dbh.IsPaired(i), " paired", ""), w)
 		}
 	}
 
-	result := map[string]*contigEntry{}
-	files, _ := filepath.Glob(*oksGlob)
-	if len(files) == 0 {
-		return nil, fmt.Errorf("no OKs files found")
+	wl := est.Candidates()
+	fmt.Fprintln(os.Stderr, "Found", len(wl), "candidate genomes")
+	if printWhiteList {
+		fmt.Fprintln(os.Stderr, wl)
+	}
+	st2, err := est.SecondPass(withProgress(s.store.reader()))
+	if err != nil {
+		return nil, err
+	}
+	printPassStats(st2)
+	fmt.Fprintln(os.Stderr, "Filtered binom:", st2.FilteredBinom)
+	if params.GCCorrect && est.GCCurve() == nil {
+		fmt.Fprintln(os.Stderr, "WARNING: not enough buckets with GC data, "+
+			"skipped GC correction")
 	}
 
-	for _, file := range files {
-		for e, err := range jio.Iter[entry](file) {
-			if err != nil {
-				return nil, err
+	abnd := est.Genomes()
+	fmt.Fprintln(os.Stderr, "Grouped to", len(abnd), "genomes")
+
+	fmt.Fprintln(os.Stderr, "Saving")
+	if err := table.Write(s.out, abnd, *toJSON, *bootstrap > 0); err != nil {
+		return nil, err
+	}
+
+	if s.qc != "" {
+		qc := &qcReport{
+			Aligner:    *alignerName,
+			FirstPass:  st,
+			SecondPass: st2,
+			Candidates: len(wl),
+			Genomes:    len(abnd),
+			Params:     params,
+			Weights:    est.ProfileWeights(),
+			GCCurve:    est.GCCurve(),
+		}
+		if s.sam != "" {
+			qc.Aligner = ""
+			qc.Input = []string{s.sam}
+		} else {
+			qc.Input = snm.FilterSlice([]string{s.in1, s.in2},
+				func(s string) bool { return s != "" })
+		}
+		if b, ok := al.(*bowtie.Bowtie); ok && s.sam == "" {
+			qc.Alignment = b.Stats()
+		}
+		if err := jio.Write(s.qc, qc); err != nil {
+			return nil, err
+		}
+	}
+	return &sampleResult{est: est, first: st, header: header,
+		genomes: abnd}, nil
+}
+
+// Prints the bundyx build parameters and warns about possible mismatches
+// with this run.
+func checkDBHeader(h *bxdb.Header, msk *mask.Mask) {
+	if h == nil {
+		fmt.Fprintln(os.Stderr, "WARNING: bundyx data is in the legacy "+
+			"format, build parameters cannot be verified")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\tBuilt with: %+v\n", *h)
+	if *inSAM == "" && h.Aligner != "" && h.Aligner != *alignerName {
+		fmt.Fprintf(os.Stderr, "WARNING: bundyx data was built with %s "+
+			"but running with %s\n", h.Aligner, *alignerName)
+	}
+	if msk != nil && h.MaskChecksum != msk.Checksum() ||
+		msk == nil && h.MaskChecksum != "" {
+		fmt.Fprintln(os.Stderr, "WARNING: bundyx data was built with a "+
+			"different mask (-mask)")
+	}
+}
+
+// Checks the reference sequences against the bundyx data once the first
+// alignment arrives.
+func withRefCheck(sams iter.Seq2[*sam.SAM, error],
+	header func() *samfile.Header, db map[string]*abundance.Contig,
+	dbh *bxdb.Header) iter.Seq2[*sam.SAM, error] {
+	return func(yield func(*sam.SAM, error) bool) {
+		checked := false
+		for sm, err := range sams {
+			if !checked && err == nil {
+				checked = true
+				if err := checkRefs(header(), db, dbh); err != nil {
+					yield(nil, err)
+					return
+				}
 			}
-			result[e.Name] = &contigEntry{
-				ok: e.OK, all: e.All,
-				buckets: &bucketOKs{e.Buckets.Buckets, e.Buckets.OK},
+			if !yield(sm, err) {
+				return
 			}
 		}
 	}
-	return result, nil
 }
 
-// Returns a float as an integer, rounded to the nearest whole.
-func iround(f float64) int {
-	return int(math.Round(f))
+// Checks that the reference sequences in a SAM header match the bundyx data.
+func checkRefs(h *samfile.Header, db map[string]*abundance.Contig,
+	dbh *bxdb.Header) error {
+	if len(h.Refs) == 0 {
+		fmt.Fprintln(os.Stderr,
+			"WARNING: no @SQ lines in SAM header, skipping reference check")
+		return nil
+	}
+	if dbh != nil && dbh.RefChecksum != "" &&
+		dbh.RefChecksum != bxdb.RefChecksum(h.Refs) {
+		if !*force {
+			return fmt.Errorf("bundyx data was built from a different " +
+				"reference than the alignments' (use -force to run anyway)")
+		}
+		fmt.Fprintln(os.Stderr, "WARNING: bundyx data was built from a "+
+			"different reference than the alignments'")
+	}
+	var missing []string
+	names := map[string]bool{}
+	for _, ref := range h.Refs {
+		names[ref.Name] = true
+		if db[ref.Name] == nil {
+			missing = append(missing, ref.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d of %d reference sequences in the alignments "+
+			"are not in the bundyx data, for example %q",
+			len(missing), len(h.Refs), missing[0])
+	}
+	nmissing := 0
+	for name := range db {
+		if !names[name] {
+			nmissing++
+		}
+	}
+	if nmissing > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d of %d bundyx sequences are not "+
+			"in the alignments' header\n", nmissing, len(db))
+	}
+	return nil
+}
+
+// Quality control information of a single run.
+type qcReport struct {
+	Input      []string             `json:"input"`
+	Aligner    string               `json:"aligner,omitempty"`
+	Alignment  *bowtie.Stats        `json:"alignment,omitempty"` // Bowtie2's alignment summary.
+	FirstPass  *abundance.PassStats `json:"firstPass"`
+	SecondPass *abundance.PassStats `json:"secondPass"`
+	Candidates int                  `json:"candidates"` // Candidate genomes after first pass.
+	Genomes    int                  `json:"genomes"`    // Genomes in the output.
+	Params     *abundance.Params    `json:"params"`
+	Weights    []float64            `json:"profileWeights"`    // Weight of each bundyx read length.
+	GCCurve    *abundance.GCCurve   `json:"gcCurve,omitempty"` // Fitted GC bias, with -gc.
 }
 
-// Populates the species debug map according to the constant.
-func createPrintSpeciesMap() map[string]bool {
-	if printSpecies == "" {
+// Returns the read lengths of the bundyx profiles, or nil if unknown.
+func dbReadLens(h *bxdb.Header) []int {
+	if h == nil {
 		return nil
 	}
-	m := map[string]bool{}
-	for _, s := range strings.Split(printSpecies, ",") {
-		m[s] = true
+	return h.ReadLens
+}
+
+// Returns which of the bundyx profiles are paired-end, or nil if unknown.
+func dbPaired(h *bxdb.Header) []bool {
+	if h == nil {
+		return nil
 	}
-	return m
+	return h.Paired
 }
 
-// Returns a map from species to relative abundance.
-func entriesToAbundances(m map[string]*contigEntry, ratio int, mz float64, maxBinom float64) map[string]float64 {
-	abnd := map[string]float64{}
-	aggEntries := snm.NewDefaultMap(func(s string) *contigEntry {
-		return &contigEntry{counts: []int{0}}
-	})
-	aggBuckets := map[string][]float64{} // TODO(amit): See if I can get rid of this.
-	aggOK := map[string]int{}            // Original OKs before subtracting in normCounts, for debugging.
-	for s, e := range m {
-		match := nameRE.FindString(s)
-		agg := aggEntries.Get(match)
-		agg.all += e.all
-		agg.ok += e.ok
-		aggOK[match] += len(e.buckets.ok)
-		bucketSize := e.all / len(e.buckets.ok)
-		normCounts := snm.Slice(len(e.buckets.ok), func(i int) float64 {
-			if e.buckets.ok[i] < bucketSize/10 {
-				agg.ok -= e.buckets.ok[i]
-				agg.all -= bucketSize
-				return math.NaN()
-			}
-			cnt := 0
-			if len(e.counts) > 0 {
-				cnt = e.counts[i]
-			}
-			return float64(cnt) * float64(bucketSize) / float64(e.buckets.ok[i])
-		})
+// Registers the estimation parameter flags.
+func paramsFlags() *abundance.Params {
+	p := abundance.DefaultParams()
+	flag.IntVar(&p.QualThresh, "q1", p.QualThresh,
+		"Mapping quality threshold for first pass")
+	flag.IntVar(&p.QualThresh2, "q2", p.QualThresh2,
+		"Mapping quality threshold for second pass")
+	flag.IntVar(&p.DenseSumRatio, "dsr1", p.DenseSumRatio,
+		"Dense sum ratio for first pass")
+	flag.IntVar(&p.DenseSumRatio2, "dsr2", p.DenseSumRatio2,
+		"Dense sum ratio for second pass")
+	flag.Float64Var(&p.MinNZ, "nz1", p.MinNZ,
+		"Minimal fraction of covered buckets for first pass")
+	flag.Float64Var(&p.MinNZ2, "nz2", p.MinNZ2,
+		"Minimal fraction of covered buckets for second pass")
+	flag.Float64Var(&p.MaxBinomialErr, "maxbinom", p.MaxBinomialErr,
+		"Disqualify genomes with this binomial error (0 to disable)")
+	flag.BoolVar(&p.GCCorrect, "gc", p.GCCorrect,
+		"Correct for GC-content bias (requires bundyx data with GC)")
+	return &p
+}
 
-		normCounts = snm.FilterSlice(normCounts, func(f float64) bool {
-			return !math.IsNaN(f) && !math.IsInf(f, 0)
+// Reads the parameters file if given, then validates the parameters.
+// Flags that were set explicitly override the file.
+func loadParams() error {
+	if *paramsFile != "" {
+		set := map[string]string{}
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = f.Value.String()
 		})
-		aggBuckets[match] = append(aggBuckets[match], normCounts...)
-	}
-	filteredBinom := 0
-	for s, e := range aggEntries.M {
-		if printSpecies != "" && speciesToPrint[s] {
-			toPrint := fmt.Sprintf("%.0f", aggBuckets[s])
-			nzeros := len(snm.FilterSlice(aggBuckets[s], func(f float64) bool {
-				return f == 0
-			}))
-			pzeros := float64(nzeros) / float64(len(aggBuckets[s])) * 100
-			nzperc := fmt.Sprintf("%.0f%%", 100-pzeros)
-			binerr := fmt.Sprintf("%.2f", binomialError(aggBuckets[s], aggOK[s]))
-			fmt.Fprintln(os.Stderr, s, len(aggBuckets[s]), aggOK[s], nzperc, binerr, toPrint)
+		if err := abundance.ReadParams(*paramsFile, params); err != nil {
+			return err
+		}
+		for name, value := range set {
+			if err := flag.Set(name, value); err != nil {
+				return err
+			}
 		}
-		e.sum = fDenseSum(aggBuckets[s], ratio, mz)
-		if e.sum > 0 && maxBinom > 0 && binomialError(aggBuckets[s], aggOK[s]) > maxBinom {
-			e.sum = 0
-			filteredBinom++
+	}
+	return params.Validate()
+}
+
+// Writes the alignments to the intermediate storage while passing them on,
+// reporting progress along the way. The storage is created with the given
+// header once the first alignment arrives.
+func teeSams(sams iter.Seq2[*sam.SAM, error], header func() *samfile.Header,
+	store *samStore) iter.Seq2[*sam.SAM, error] {
+	return func(yield func(*sam.SAM, error) bool) {
+		pt := ptimer.NewMessage("Loading reference")
+		defer func() { pt.Done() }()
+		var w samfile.Writer
+		for sm, err := range sams {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if pt.N == 0 {
+				pt.Done()
+				pt = ptimer.NewMessage("{} reads processed")
+				pt.Inc()
+			}
+			pt.Inc()
+
+			if w == nil {
+				if w, err = store.writer(header()); err != nil {
+					yield(nil, err)
+					return
+				}
+			}
+			if err := w.Write(sm); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(sm, nil) {
+				return
+			}
 		}
-		if e.sum == 0 || e.ok == 0 {
-			continue
+		if w == nil { // No alignments, create empty storage.
+			var err error
+			if w, err = store.writer(header()); err != nil {
+				yield(nil, err)
+				return
+			}
 		}
-		if !*ignoreLength {
-			abnd[s] = e.sum / float64(e.all)
-		} else {
-			abnd[s] = e.sum * float64(e.all) / float64(e.ok)
+		if err := w.Close(); err != nil {
+			yield(nil, err)
 		}
 	}
-	if maxBinom > 0 {
-		fmt.Fprintln(os.Stderr, "Filtered binom:", filteredBinom)
+}
+
+// Passes on the alignments, reporting progress along the way.
+func withProgress(sams iter.Seq2[*sam.SAM, error],
+) iter.Seq2[*sam.SAM, error] {
+	return func(yield func(*sam.SAM, error) bool) {
+		pt := ptimer.NewMessage("{} reads processed")
+		defer pt.Done()
+		for sm, err := range sams {
+			pt.Inc()
+			if !yield(sm, err) {
+				return
+			}
+		}
 	}
-	toSum1(abnd)
-	return abnd
 }
 
-// Returns a count map for the given entries.
-func entriesToRawCounts(m map[string]*contigEntry) map[string]float64 {
-	abnd := map[string]float64{}
-	for s, e := range m {
-		match := nameRE.FindString(s)
-		abnd[match] += float64(gnum.Sum(e.counts))
+// Prints the counts of a single pass.
+func printPassStats(st *abundance.PassStats) {
+	if printNReads {
+		fmt.Println("NReads:", st.NReads)
+	}
+	fmt.Fprintf(os.Stderr, "Mapped OK %v | Low quality %v | Unmapped %v\n",
+		common.Percf(st.All-st.Unmapped-st.LowQual, st.All, 0),
+		common.Percf(st.LowQual, st.All, 0),
+		common.Percf(st.Unmapped, st.All, 0))
+	if st.Masked > 0 {
+		fmt.Fprintf(os.Stderr, "Masked %v\n", common.Percf(st.Masked, st.All, 0))
 	}
-	return abnd
 }
 
-// Normalizes m's values to sum up to 1.
-func toSum1(m map[string]float64) {
-	sum := gnum.Sum(maps.Values(m))
-	for k := range m {
-		m[k] /= sum
+// Shortens a string for display.
+func shortenString(s string, n int) string {
+	if len(s) <= n {
+		return s
 	}
+	const filler = " ... "
+	pre := (n - len(filler)) / 2
+	suf := (n - len(filler) + 1) / 2
+	return s[:pre] + filler + s[len(s)-suf:]
 }
 
 // Writes the given SAM line as a fastq entry.
@@ -547,27 +632,11 @@ func writeSamAsFastq(sm *sam.SAM, w io.Writer) error {
 	return err
 }
 
-// Returns the binomial STD for the given params.
-func binomialError(abnd []float64, nn int) float64 {
-	n := len(abnd)
-	k := gnum.Sum(abnd)
-	q := float64(nn-n) / float64(nn)
-	return math.Sqrt(q / k)
-}
-
-// Returnes true if this SAM entry was mapped properly,
-// depending on whether it's single or paried end.
-func samMapped(sm *sam.SAM) bool {
-	paired := *inFile2 != "" || *interleaved
-	return (paired && sm.Flag&sam.FlagEach > 0) ||
-		(!paired && sm.Flag&sam.FlagUnmapped == 0)
-}
-
 // Closes non-nil writers.
-func closeAll(w ...io.WriteCloser) error {
+func closeAll[T io.Closer](w ...T) error {
 	var err error
 	for _, w := range w {
-		if w != nil {
+		if any(w) != nil {
 			err = w.Close()
 		}
 	}
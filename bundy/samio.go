@@ -3,29 +3,52 @@
 package main
 
 import (
-	"io"
 	"iter"
 
 	"github.com/fluhus/biostuff/formats/sam"
 	"github.com/fluhus/bundy/mybuf"
-	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/bundy/samfile"
 )
 
-// Returns a writer based on the diskmode argument.
-func samWriter() (io.WriteCloser, error) {
-	if *diskMode != "" {
-		return aio.Create(*diskMode)
-	}
-	return sambuf, nil
+// Intermediate storage of a sample's alignments, in memory or on disk.
+// The memory mode buffer holds only the records, without the header.
+type samStore struct {
+	file string        // Disk mode file, empty for memory mode.
+	buf  *mybuf.Buffer // Memory mode buffer.
+}
+
+// Returns a storage in the given file, or in memory if file is empty.
+func newSamStore(file string) *samStore {
+	return &samStore{file: file, buf: &mybuf.Buffer{}}
 }
 
-// Returns a reader based on the diskmode argument.
-func samReader() iter.Seq2[*sam.SAM, error] {
-	if *diskMode != "" {
-		return sam.File(*diskMode)
+// Returns a writer to the storage.
+func (s *samStore) writer(h *samfile.Header) (samfile.Writer, error) {
+	if s.file != "" {
+		return samfile.Create(s.file, h)
 	}
-	return sam.Reader(sambuf.Reader())
+	return samfile.NewWriter(s.buf, nil)
 }
 
-// A buffer for memory mode.
-var sambuf = &mybuf.Buffer{}
+// Returns a reader over the stored alignments.
+func (s *samStore) reader() iter.Seq2[*sam.SAM, error] {
+	return func(yield func(*sam.SAM, error) bool) {
+		var r *samfile.Reader
+		var err error
+		if s.file != "" {
+			r, err = samfile.Open(s.file)
+		} else {
+			r, err = samfile.NewReader(s.buf.Reader())
+		}
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer r.Close()
+		for sm, err := range r.Iter() {
+			if !yield(sm, err) {
+				return
+			}
+		}
+	}
+}
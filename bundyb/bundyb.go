@@ -0,0 +1,88 @@
+// Builds a complete bundy reference: the bowtie2 index and the bundyx data.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fluhus/bundy/aligner"
+	"github.com/fluhus/bundy/bowtie"
+	"github.com/fluhus/bundy/common"
+	"github.com/fluhus/bundy/mappability"
+)
+
+var (
+	inGlob      = flag.String("i", "", "Input fasta file glob pattern")
+	refFile     = flag.String("o", "", "Output bowtie2 index prefix")
+	readLensStr = flag.String("l", "100", "Read lengths, comma separated (e.g. 75,100,150)")
+	nthreads    = flag.Int("t", 1, "Number of threads")
+	readStep    = flag.Int("s", mappability.DefaultReadStep, "Distance between consecutive simulated reads")
+	bucketSize  = flag.Int("b", mappability.DefaultBucketSize, "Target bucket size in bases")
+	minQual     = flag.Int("q", mappability.DefaultMinQual, "Minimal mapping quality for a simulated read to count as unique")
+	fast        = flag.Bool("fast", false, "Use bowtie2's fast mode for bundyx, loses some accuracy")
+
+	inFiles  []string
+	readLens []int
+)
+
+func main() {
+	common.Die(parseArgs())
+	ctx := common.SignalContext()
+
+	fmt.Println("Found", len(inFiles), "input files")
+	fmt.Println("Read lengths:", readLens)
+
+	fmt.Println("Building bowtie2 index")
+	t := time.Now()
+	common.Die(bowtie.BuildIndex(ctx, inFiles, *refFile, *nthreads))
+	fmt.Println("Took", time.Since(t))
+
+	fmt.Println("Running bundyx")
+	t = time.Now()
+	dir := *refFile + ".bx"
+	common.Die(os.MkdirAll(dir, 0o744))
+	out := filepath.Join(dir, "1")
+	al, err := aligner.New(aligner.Bowtie2, *refFile, *nthreads, *fast)
+	common.Die(err)
+	common.Die(mappability.Compute(ctx, al, inFiles, out,
+		&mappability.Config{
+			Aligner:    aligner.Bowtie2,
+			Fast:       *fast,
+			ReadLens:   readLens,
+			ReadStep:   *readStep,
+			BucketSize: *bucketSize,
+			MinQual:    *minQual,
+			Part:       1,
+			NParts:     1,
+		}))
+	fmt.Println("Took", time.Since(t))
+	fmt.Println("Wrote to:", dir)
+	fmt.Println("Done")
+}
+
+// Parses and checks arguments.
+func parseArgs() error {
+	flag.Parse()
+	var err error
+	if readLens, err = common.ParseInts(*readLensStr); err != nil {
+		return fmt.Errorf("bad read lengths (-l): %w", err)
+	}
+	for _, rl := range readLens {
+		if rl <= 0 {
+			return fmt.Errorf("bad read length (-l): %d", rl)
+		}
+	}
+	if inFiles, _ = filepath.Glob(*inGlob); len(inFiles) == 0 {
+		return fmt.Errorf("no input files found (-i)")
+	}
+	if *refFile == "" {
+		return fmt.Errorf("no output index selected (-o)")
+	}
+	if *nthreads < 1 {
+		return fmt.Errorf("bad number of threads (-t): %d", *nthreads)
+	}
+	return nil
+}
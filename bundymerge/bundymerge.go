@@ -0,0 +1,140 @@
+// Merges bundy outputs of multiple samples into a single table.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/fluhus/bundy/abundance"
+	"github.com/fluhus/bundy/common"
+	"github.com/fluhus/bundy/table"
+)
+
+// Extensions trimmed from file names to get the default sample names.
+var trimExts = []string{".gz", ".zst", ".bz2", ".tsv", ".json", ".txt"}
+
+var (
+	inGlob   = flag.String("i", "", "Input bundy output files glob pattern, TSV or JSON")
+	outFile  = flag.String("o", "", "Output file")
+	column   = flag.String("v", "abundance", "Value to output (abundance, reads, est_reads, mean_depth, median_depth, copies, std_err, ci_low, ci_high)")
+	long     = flag.Bool("long", false, "Write a long table of sample, genome and value rather than a genome-by-sample matrix")
+	fill     = flag.String("fill", "0", "Value for genomes missing from a sample, in matrix output")
+	minAbund = flag.Float64("min", 0, "Minimal abundance for a genome to count as present in a sample")
+	minPrev  = flag.Float64("prev", 0, "Minimal fraction of samples a genome must be present in (default: at least one sample)")
+	namePat  = flag.String("n", "", "Regular expression for extracting sample names from file names, using the first group if any (default: file name without extension)")
+
+	inFiles []string
+	nameRE  *regexp.Regexp
+	value   func(*abundance.GenomeStats) float64
+)
+
+func main() {
+	common.Die(parseArgs())
+
+	fmt.Println("Reading", len(inFiles), "files")
+	samples, err := sampleNames(inFiles)
+	common.Die(err)
+	tables := make([]map[string]*abundance.GenomeStats, len(inFiles))
+	for i, file := range inFiles {
+		tables[i], err = table.Read(file)
+		common.Die(err)
+	}
+
+	m := table.NewMatrix(samples, tables, value)
+	n := len(m.Genomes)
+	prev := prevalence(tables)
+	m.Filter(func(genome string, _ []float64) bool {
+		return prev[genome] > 0 &&
+			float64(prev[genome]) >= *minPrev*float64(len(tables))
+	})
+	fmt.Println("Found", n, "genomes, kept", len(m.Genomes))
+
+	if *long {
+		common.Die(m.WriteLong(*outFile, *column))
+	} else {
+		common.Die(m.WriteWide(*outFile, *fill))
+	}
+	fmt.Println("Wrote to:", *outFile)
+}
+
+// Parses and checks arguments.
+func parseArgs() error {
+	flag.Parse()
+	if inFiles, _ = filepath.Glob(*inGlob); len(inFiles) == 0 {
+		return fmt.Errorf("no input files found (-i)")
+	}
+	if *outFile == "" {
+		return fmt.Errorf("no output file (-o)")
+	}
+	if slices.Contains(inFiles, *outFile) {
+		return fmt.Errorf("output file matches the input pattern")
+	}
+	if *minPrev < 0 || *minPrev > 1 {
+		return fmt.Errorf("bad prevalence (-prev): %v, should be in [0,1]",
+			*minPrev)
+	}
+	var err error
+	if value, err = table.Field(*column); err != nil {
+		return fmt.Errorf("bad value (-v): %w", err)
+	}
+	if *namePat != "" {
+		if nameRE, err = regexp.Compile(*namePat); err != nil {
+			return fmt.Errorf("bad sample name pattern (-n): %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns the sample name of each file.
+func sampleNames(files []string) ([]string, error) {
+	names := make([]string, len(files))
+	seen := map[string]string{}
+	for i, file := range files {
+		name, err := sampleName(file)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("sample name %q of %s is also the name of %s",
+				name, file, other)
+		}
+		seen[name] = file
+		names[i] = name
+	}
+	return names, nil
+}
+
+// Returns the sample name of the given file.
+func sampleName(file string) (string, error) {
+	if nameRE == nil {
+		name := filepath.Base(file)
+		for _, ext := range trimExts {
+			name = strings.TrimSuffix(name, ext)
+		}
+		return name, nil
+	}
+	match := nameRE.FindStringSubmatch(file)
+	if match == nil {
+		return "", fmt.Errorf("file name does not match the sample name "+
+			"pattern (-n): %s", file)
+	}
+	return common.If(len(match) > 1, match[1], match[0]), nil
+}
+
+// Returns the number of samples each genome is present in, with at least
+// the minimal abundance.
+func prevalence(tables []map[string]*abundance.GenomeStats) map[string]int {
+	prev := map[string]int{}
+	for _, t := range tables {
+		for name, g := range t {
+			if g.Abundance >= *minAbund {
+				prev[name]++
+			}
+		}
+	}
+	return prev
+}
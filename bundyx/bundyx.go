@@ -2,70 +2,124 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"iter"
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"time"
 
-	"github.com/fluhus/biostuff/formats/fasta"
-	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/aligner"
 	"github.com/fluhus/bundy/bowtie"
+	"github.com/fluhus/bundy/bxdb"
 	"github.com/fluhus/bundy/common"
-	"github.com/fluhus/gostuff/aio"
-	"github.com/fluhus/gostuff/gnum"
-	"github.com/fluhus/gostuff/hashx"
-	"github.com/fluhus/gostuff/ptimer"
-	"github.com/fluhus/gostuff/sets"
-	"github.com/fluhus/gostuff/snm"
-)
-
-const (
-	qualThresh  = 2
-	readStep    = 4
-	bucket2Size = 1000
-
-	useFastBowtie = false // Experiment: use bowtie's fast mapping.
+	"github.com/fluhus/bundy/mappability"
+	"github.com/fluhus/bundy/mask"
+	"github.com/fluhus/bundy/simreads"
 )
 
 var (
-	refFile      = flag.String("x", "", "Bowtie reference")
-	inGlob       = flag.String("i", "", "Input file glob pattern")
-	outFile      = flag.String("o", "", "Output file (default: bowtie_reference.bx/part_number)")
-	readLen      = flag.Int("l", 100, "Read length")
-	nthreads     = flag.Int("t", 1, "Number of threads")
+	refFile      = flag.String("x", "", "Aligner reference (bowtie2 index, or minimap2 index or fasta)")
+	alignerName  = flag.String("a", aligner.Bowtie2, "Aligner to use: bowtie2 or minimap2")
+	inGlob       = flag.String("i", "", "Input file glob pattern (default: extract the sequences from the bowtie2 index)")
+	outFile      = flag.String("o", "", "Output file (default: bowtie_reference.bx/part_number, or bowtie_reference.bxdb with -np)")
+	readLensStr  = flag.String("l", "100", "Read lengths, comma separated (e.g. 75,100,150)")
+	nthreads     = flag.Int("t", 1, "Number of threads per aligner")
+	readStep     = flag.Int("s", mappability.DefaultReadStep, "Distance between consecutive simulated reads")
+	bucketSize   = flag.Int("b", mappability.DefaultBucketSize, "Target bucket size in bases")
+	balanced     = flag.Bool("balance", false, "Place bucket boundaries so that buckets have similar amounts of unique sequence, rather than similar sizes")
+	minQual      = flag.Int("q", mappability.DefaultMinQual, "Minimal mapping quality for a simulated read to count as unique")
+	fast         = flag.Bool("fast", false, "Use the aligner's fast mode, loses some accuracy")
 	part, nparts = partFlag()
-
-	inFiles []string
+	localParts   = flag.Int("np", 0, "Run this many parts locally and merge them (parts are written to bowtie_reference.bx)")
+	workers      = flag.Int("w", 1, "Number of parts to run in parallel with -np")
+	errRate      = flag.Float64("err", 0, "Add substitution errors to the simulated reads at this rate")
+	errQuals     = flag.String("errq", "", "Add substitution errors to the simulated reads according to this per-position phred quality profile, comma separated (e.g. 38,38,37,...)")
+	errSeed      = flag.Uint64("seed", 0, "Random seed for simulated errors and insert sizes")
+	insMean      = flag.Float64("ins", 0, "Also simulate read pairs with this mean insert size, for paired-end profiles")
+	insSD        = flag.Float64("inssd", 0, "Standard deviation of the insert size with -ins")
+	maskFile     = flag.String("mask", "", "BED `file` of regions to exclude from the unique counts")
+	planFile     = flag.String("plan", "", "Partition plan `file`, assigning sequences to parts by size (created if missing)")
+
+	inFiles  []string
+	readLens []int
 )
 
 func main() {
 	common.Die(parseArgs())
+	ctx := common.SignalContext()
+	if *inGlob == "" {
+		common.Die(extractFasta(ctx))
+	}
 
 	fmt.Println("Found", len(inFiles), "input files")
-	fmt.Println("Read length:", *readLen)
-	fmt.Println("Read step:", readStep)
-	fmt.Println("Qual:", qualThresh)
-	fmt.Printf("Part: %d/%d\n", *part, *nparts)
+	fmt.Println("Aligner:", *alignerName)
+	fmt.Println("Read lengths:", readLens)
+	fmt.Println("Read step:", *readStep)
+	fmt.Println("Bucket size:", *bucketSize)
+	fmt.Println("Balanced buckets:", *balanced)
+	fmt.Println("Qual:", *minQual)
+	fmt.Println("Fast:", *fast)
+	c := &mappability.Config{
+		Aligner:    *alignerName,
+		Fast:       *fast,
+		ReadLens:   readLens,
+		ReadStep:   *readStep,
+		BucketSize: *bucketSize,
+		Balanced:   *balanced,
+		MinQual:    *minQual,
+		Part:       *part,
+		NParts:     *nparts,
+	}
+	newAligner := func() (aligner.Aligner, error) {
+		return aligner.New(*alignerName, *refFile, *nthreads, *fast)
+	}
+
+	if *errRate != 0 || *errQuals != "" {
+		c.Errors = &simreads.ErrorModel{SubRate: *errRate, Seed: *errSeed}
+		if *errQuals != "" {
+			quals, err := common.ParseInts(*errQuals)
+			common.Die(err)
+			c.Errors.Quals = quals
+		}
+		fmt.Println("Simulated errors:", c.Errors)
+	}
+	if *insMean != 0 {
+		c.Insert = &simreads.InsertSize{Mean: *insMean, SD: *insSD,
+			Seed: *errSeed}
+		fmt.Println("Insert size:", c.Insert)
+	}
+	if *maskFile != "" {
+		m, err := mask.Load(*maskFile)
+		common.Die(err)
+		c.Mask = m
+		fmt.Println("Mask:", *maskFile)
+	}
+	if *planFile != "" {
+		plan, err := loadPlan()
+		common.Die(err)
+		c.Plan = plan
+	}
 
 	fmt.Println("Starting")
 	t := time.Now()
-	fa := makeFasta()
-	var sams iter.Seq2[*sam.SAM, error]
-	if useFastBowtie {
-		sams = bowtie.MapReader(fa, *refFile, *nthreads,
-			"-F", fmt.Sprintf("%d,%d", *readLen, readStep), "--very-fast")
+	if *localParts > 0 {
+		fmt.Printf("Parts: %d (%d in parallel)\n", *localParts, *workers)
+		c.Part, c.NParts = 1, *localParts
+		files, err := mappability.ComputeParts(ctx, newAligner, inFiles,
+			*refFile+".bx", c, *workers)
+		common.Die(err)
+		fmt.Println("Merging parts")
+		common.Die(bxdb.Merge(files, *outFile))
 	} else {
-		sams = bowtie.MapReader(fa, *refFile, *nthreads,
-			"-F", fmt.Sprintf("%d,%d", *readLen, readStep))
+		fmt.Printf("Part: %d/%d\n", *part, *nparts)
+		al, err := newAligner()
+		common.Die(err)
+		common.Die(mappability.Compute(ctx, al, inFiles, *outFile, c))
 	}
-	common.Die(checkSam(sams))
+	fmt.Println("Wrote to:", *outFile)
 	fmt.Println("Took", time.Since(t))
 	fmt.Println("Done")
 }
@@ -73,142 +127,92 @@ func main() {
 // Parses and checks arguments.
 func parseArgs() error {
 	flag.Parse()
-	if *readLen <= 0 {
-		return fmt.Errorf("bad read length (-l): %d", *readLen)
+	var err error
+	if readLens, err = common.ParseInts(*readLensStr); err != nil {
+		return fmt.Errorf("bad read lengths (-l): %w", err)
 	}
-	if inFiles, _ = filepath.Glob(*inGlob); len(inFiles) == 0 {
+	for _, rl := range readLens {
+		if rl <= 0 {
+			return fmt.Errorf("bad read length (-l): %d", rl)
+		}
+	}
+	if *inGlob == "" {
+		if *alignerName != aligner.Bowtie2 {
+			return fmt.Errorf("no input files (-i), required with %s",
+				*alignerName)
+		}
+	} else if inFiles, _ = filepath.Glob(*inGlob); len(inFiles) == 0 {
 		return fmt.Errorf("no input files found (-i)")
 	}
 	if *refFile == "" {
 		return fmt.Errorf("no reference selected (-r)")
 	}
-	if *outFile == "" {
+	if _, err := aligner.New(*alignerName, *refFile, *nthreads, *fast); err != nil {
+		return err
+	}
+	if *insSD != 0 && *insMean == 0 {
+		return fmt.Errorf("-inssd requires -ins")
+	}
+	if *localParts > 0 {
+		if *nparts != 1 {
+			return fmt.Errorf("-p and -np are mutually exclusive")
+		}
+		if *workers < 1 {
+			return fmt.Errorf("bad number of workers (-w): %d", *workers)
+		}
+		if *outFile == "" {
+			*outFile = *refFile + ".bxdb"
+		}
+	}
+	if *localParts > 0 || *outFile == "" {
 		dir := *refFile + ".bx"
 		if err := os.MkdirAll(dir, 0o744); err != nil {
 			return err
 		}
-		*outFile = filepath.Join(dir, fmt.Sprint(*part))
+		if *outFile == "" {
+			*outFile = filepath.Join(dir, fmt.Sprint(*part))
+		}
 	}
 	return nil
 }
 
-// Generates a fasta subset stream from the input genomes.
-func makeFasta() io.Reader {
-	r, w := io.Pipe()
-	go func() {
-		for _, f := range inFiles {
-			if err := makeFastaFile(f, w); err != nil {
-				w.CloseWithError(err)
-			}
-		}
-		w.Close()
-	}()
-	return r
-}
-
-// Writes fastq reads from the given fasta to the given writer.
-func makeFastaFile(file string, w io.Writer) error {
-	for fa, err := range fasta.File(file) {
-		if err != nil {
-			return err
-		}
-		if hashx.Bytes(fa.Name)%uint64(*nparts) != uint64(*part-1) {
-			continue
-		}
-		txt, _ := fa.MarshalText()
-		if _, err := w.Write(txt); err != nil {
+// Extracts the reference sequences from the bowtie2 index, unless already
+// extracted by a previous run, and uses them as input.
+func extractFasta(ctx context.Context) error {
+	file := *refFile + ".bx.fa"
+	if _, err := os.Stat(file); err == nil {
+		fmt.Println("Using extracted sequences:", file)
+	} else {
+		fmt.Println("Extracting sequences from index to:", file)
+		t := time.Now()
+		if err := bowtie.ExtractFasta(ctx, *refFile, file); err != nil {
 			return err
 		}
+		fmt.Println("Took", time.Since(t))
 	}
+	inFiles = []string{file}
 	return nil
 }
 
-// Aggregates mapping results and creates the data for bundy.
-func checkSam(sams iter.Seq2[*sam.SAM, error]) error {
-	all := map[string]int{}
-	ok := map[string]int{}
-	okPos := snm.NewDefaultMap(func(s string) sets.Set[int] {
-		return sets.Set[int]{}
-	})
-
-	pt := ptimer.NewMessage("loading reference")
-	fre := regexp.MustCompile(`^(.*)_(\d+)$`)
-
-	for sm, err := range sams {
-		if err != nil {
-			return err
-		}
-		if pt.N == 0 {
-			pt.Done()
-			pt = ptimer.NewMessage("{} reads")
-			pt.Inc()
-		}
-		pt.Inc()
-
-		var splt []string
-		match := fre.FindStringSubmatch(sm.Qname)
-		splt = []string{match[2], match[1]}
-		rname := splt[1]
-		all[rname]++
-		if sm.Flag == sam.FlagUnmapped {
-			continue
-		}
-		if sm.Mapq < qualThresh {
-			continue
-		}
-
-		ok[rname]++
-		okPosSet := okPos.Get(rname)
-		okPosSet.Add(sm.Pos)
+// Reads the partition plan file, or creates it if it does not exist.
+func loadPlan() (*mappability.Plan, error) {
+	n := common.If(*localParts, *localParts, *nparts)
+	if _, err := os.Stat(*planFile); err == nil {
+		fmt.Println("Reading partition plan:", *planFile)
+		return mappability.ReadPlan(*planFile)
 	}
-	pt.Done()
-
-	mulByReadStep(all)
-	mulByReadStep(ok)
-
-	f, err := aio.Create(*outFile)
+	fmt.Println("Creating partition plan:", *planFile)
+	plan, err := mappability.MakePlan(inFiles, n)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	j := json.NewEncoder(f)
-	for k := range all {
-		j.Encode(map[string]any{
-			"name":    k,
-			"all":     all[k],
-			"ok":      ok[k],
-			"buckets": posToBuckets(all[k], okPos.Get(k)),
-		})
+	fmt.Println("Bases per part:", plan.Bases)
+	// Write atomically, in case parallel sub-jobs create the same plan.
+	tmp := fmt.Sprintf("%s.%d.tmp", *planFile, os.Getpid())
+	if err := plan.Write(tmp); err != nil {
+		return nil, err
 	}
-	f.Close()
-	fmt.Println("Wrote to:", *outFile)
-	return nil
-}
-
-// Multiplies raw counts by read step to simulate real counts.
-func mulByReadStep(m map[string]int) {
-	for k := range m {
-		m[k] *= readStep
-	}
-}
-
-type bucketOKs struct {
-	Buckets []int
-	OK      []int
-}
-
-// Creates bucket positions from all the positions that were mapped to.
-func posToBuckets(all int, okPos sets.Set[int]) *bucketOKs {
-	nBuckets := max(1, gnum.Idiv(all, bucket2Size))
-	var buckets []int
-	for i := 1; i < nBuckets; i++ {
-		buckets = append(buckets, gnum.Idiv(all*i, nBuckets))
-	}
-	ok := make([]int, nBuckets)
-	for pos := range okPos {
-		i := sort.SearchInts(buckets, pos)
-		ok[i] += readStep
-	}
-	return &bucketOKs{buckets, ok}
+	return plan, os.Rename(tmp, *planFile)
 }
 
 func partFlag() (*int, *int) {
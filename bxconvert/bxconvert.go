@@ -0,0 +1,86 @@
+// Converts legacy JSON bundyx files to the current database format.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fluhus/bundy/bxdb"
+	"github.com/fluhus/bundy/common"
+	"github.com/fluhus/bundy/samfile"
+)
+
+var (
+	inGlob      = flag.String("i", "", "Input legacy bundyx files glob pattern")
+	outDir      = flag.String("o", "", "Output directory")
+	alignerName = flag.String("a", "", "Aligner the files were built with (default: unknown)")
+	readLen     = flag.Int("l", 0, "Read length the files were built with (default: unknown)")
+	samFile     = flag.String("s", "", "SAM/BAM `file` aligned to the reference, for the reference checksum (default: none)")
+)
+
+func main() {
+	flag.Parse()
+	files := bxdb.Glob(*inGlob)
+	if len(files) == 0 {
+		common.Die(fmt.Errorf("no input files found (-i)"))
+	}
+	if *outDir == "" {
+		common.Die(fmt.Errorf("no output directory (-o)"))
+	}
+	common.Die(os.MkdirAll(*outDir, 0o744))
+
+	// Parameters that were not recorded are left zero, meaning unknown.
+	h := &bxdb.Header{
+		Aligner:  *alignerName,
+		ReadLens: []int{*readLen},
+	}
+	if *samFile != "" {
+		sr, err := samfile.Open(*samFile)
+		common.Die(err)
+		h.RefChecksum = bxdb.RefChecksum(sr.Header.Refs)
+		sr.Close()
+	}
+
+	for i, file := range files {
+		// Default layout names parts by number.
+		hh := *h
+		hh.Part = i + 1
+		if p, err := strconv.Atoi(filepath.Base(file)); err == nil {
+			hh.Part = p
+		}
+		out := filepath.Join(*outDir, filepath.Base(file))
+		fmt.Println(file, "->", out)
+		common.Die(convert(file, out, &hh))
+	}
+	fmt.Println("Done")
+}
+
+// Converts a single file.
+func convert(in, out string, h *bxdb.Header) error {
+	r, err := bxdb.Open(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if r.Header != nil {
+		return fmt.Errorf("%s: already in version %d format", in, r.Version)
+	}
+	w, err := bxdb.Create(out, h)
+	if err != nil {
+		return err
+	}
+	for c, err := range r.Iter() {
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Write(c); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
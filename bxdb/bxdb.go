@@ -0,0 +1,414 @@
+// Package bxdb reads and writes bundyx databases.
+//
+// A database file starts with a magic string and a format version, followed
+// by a zstd-compressed gob stream of a header and then the contigs.
+// Files in the legacy JSON-lines format can be read too, with a nil header.
+package bxdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/fluhus/bundy/samfile"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	magic = "BUNDYX"
+
+	// Suffix of files that are being written, renamed on completion.
+	tmpSuffix = ".tmp"
+
+	// Version is the current format version. Version 1 has a single read
+	// length. Version 2 has multiple read lengths. Version 3 has the same
+	// layout as version 2, and marks databases that may use header fields
+	// that change the meaning of the profiles, like paired profiles, so that
+	// older builds refuse them rather than misread them.
+	Version = 3
+)
+
+// Header holds the parameters a database was built with.
+// Legacy files have no header and a single profile of unknown read length.
+// Zero values mean unknown, as in files converted from the legacy format.
+type Header struct {
+	Aligner     string // Aligner used for mapping the k-mers.
+	Fast        bool   // Whether the aligner ran in fast mode.
+	ReadLens    []int  // Lengths of the simulated reads, one per profile.
+	ReadStep    int    // Distance between consecutive simulated reads.
+	BucketSize  int    // Target bucket size, in bases.
+	Balanced    bool   // Buckets have similar numbers of unique reads rather than similar sizes.
+	MinQual     int    // Minimal mapping quality for a unique read.
+	RefChecksum string // Checksum of the reference sequences, see RefChecksum.
+	Part        int    // Part number, starting from 1.
+	NParts      int    // Total number of parts.
+
+	// Checksum of the partition plan, empty if partitioned by name hash.
+	PlanChecksum string
+
+	// Description of the sequencing errors added to the simulated reads,
+	// empty for exact reads.
+	SimErrors string
+
+	// Whether each profile was computed from simulated read pairs, parallel
+	// to ReadLens. Nil means all profiles are single-end.
+	Paired []bool
+
+	// Description of the insert size distribution of the simulated read
+	// pairs, empty if there are no paired profiles.
+	InsertSize string
+
+	// Checksum of the regions masked from the unique counts, empty if
+	// there is no mask.
+	MaskChecksum string
+
+	// Number of contigs in the file, 0 if unknown. Set in indexed files.
+	NContigs int
+}
+
+// Contig holds the mappability data of a single reference sequence.
+type Contig struct {
+	Name     string
+	Buckets  []int     // Bucket boundaries, shared by all profiles.
+	BucketGC []float64 // GC fraction of each bucket, NaN if unknown. Nil in older files.
+	Profiles []Profile // One per header read length, in the header's order.
+}
+
+// Profile holds the mappability data of a contig for a single read length,
+// single or paired-end. Paired-end counts are per fragment, like single-end
+// counts are per read.
+type Profile struct {
+	All      int   // Number of simulated reads.
+	OK       int   // Number of uniquely mapped simulated reads.
+	BucketOK []int // Number of uniquely mapped reads in each bucket.
+}
+
+// SameBuild returns an error if the two headers differ in anything other than
+// their part number.
+func (h *Header) SameBuild(other *Header) error {
+	a, b := *h, *other
+	a.Part, b.Part = 0, 0
+	if !reflect.DeepEqual(a, b) {
+		return fmt.Errorf("mismatching build parameters: %+v vs. %+v",
+			*h, *other)
+	}
+	return nil
+}
+
+// IsPaired returns whether the i'th profile is of paired-end reads.
+func (h *Header) IsPaired(i int) bool {
+	return i < len(h.Paired) && h.Paired[i]
+}
+
+// Glob returns the files matching the given pattern, excluding temporary
+// files of unfinished databases.
+func Glob(pattern string) []string {
+	files, _ := filepath.Glob(pattern)
+	return slices.DeleteFunc(files, func(f string) bool {
+		return strings.HasSuffix(f, tmpSuffix)
+	})
+}
+
+// RefChecksum returns a checksum of the names and lengths of the given
+// reference sequences, regardless of their order.
+func RefChecksum(refs []samfile.Ref) string {
+	lines := make([]string, len(refs))
+	for i, ref := range refs {
+		lines[i] = fmt.Sprintf("%s\t%d\n", ref.Name, ref.Len)
+	}
+	slices.Sort(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Writer writes a database file.
+type Writer struct {
+	f   io.WriteCloser
+	z   *zstd.Encoder
+	e   *gob.Encoder
+	cw  *countingWriter // Position in the output, for indexed databases.
+	idx *index          // Nil for databases without an index.
+	n   int             // Number of contigs written.
+}
+
+// Create creates a database file with the given header.
+// The data is written to a temporary file that replaces the target file on
+// Close, so the target file is either absent or complete. Temporary files
+// left by interrupted runs are skipped by Glob.
+func Create(file string, h *Header) (*Writer, error) {
+	return create(file, h, false)
+}
+
+// CreateIndexed creates a database file with the given header, like Create,
+// followed by an index of the contigs' positions for OpenIndex.
+// h.NContigs should be the number of contigs that will be written.
+func CreateIndexed(file string, h *Header) (*Writer, error) {
+	return create(file, h, true)
+}
+
+// Creates a database file, with or without an index.
+func create(file string, h *Header, indexed bool) (*Writer, error) {
+	tmp := file + tmpSuffix
+	f, err := aio.CreateRaw(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWriter(&atomicFile{f, tmp, file}, h, indexed)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return w, nil
+}
+
+// A temporary file that is renamed to its target when closed.
+type atomicFile struct {
+	*aio.Writer
+	tmp, file string
+}
+
+func (f *atomicFile) Close() error {
+	if err := f.Writer.Close(); err != nil {
+		os.Remove(f.tmp)
+		return err
+	}
+	return os.Rename(f.tmp, f.file)
+}
+
+// Discards the written data.
+func (f *atomicFile) abort() {
+	f.Writer.Close()
+	os.Remove(f.tmp)
+}
+
+// NewWriter returns a writer that writes a database with the given header
+// to w. Closing it closes w.
+func NewWriter(w io.WriteCloser, h *Header) (*Writer, error) {
+	return newWriter(w, h, false)
+}
+
+// Returns a writer, with or without an index.
+func newWriter(w io.WriteCloser, h *Header, indexed bool) (*Writer, error) {
+	cw := &countingWriter{w: w}
+	buf := binary.LittleEndian.AppendUint16([]byte(magic), Version)
+	if _, err := cw.Write(buf); err != nil {
+		return nil, err
+	}
+	z, err := zstd.NewWriter(cw, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	e := gob.NewEncoder(z)
+	if err := e.Encode(h); err != nil {
+		return nil, err
+	}
+	wr := &Writer{f: w, z: z, e: e, cw: cw}
+	if indexed {
+		wr.idx = &index{}
+	}
+	return wr, nil
+}
+
+// Write writes a single contig.
+func (w *Writer) Write(c *Contig) error {
+	if w.idx != nil {
+		if err := w.startFrame(c.Name); err != nil {
+			return err
+		}
+	}
+	w.n++
+	return w.e.Encode(c)
+}
+
+// Close flushes the data and closes the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.z.Close(); err != nil {
+		w.Abort()
+		return err
+	}
+	if w.idx != nil {
+		if err := w.writeIndex(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.f.Close()
+}
+
+// Abort closes the underlying writer without completing the database.
+// If created with Create, the target file is left untouched.
+func (w *Writer) Abort() {
+	w.z.Close()
+	if f, ok := w.f.(*atomicFile); ok {
+		f.abort()
+	} else {
+		w.f.Close()
+	}
+}
+
+// Reader reads a database file.
+type Reader struct {
+	Header  *Header // Nil for legacy files.
+	Version int     // 0 for legacy files.
+
+	c    io.Closer
+	z    *zstd.Decoder
+	next func() (*Contig, error)
+}
+
+// Open opens a database file, in the current or in the legacy format.
+func Open(file string) (*Reader, error) {
+	f, err := aio.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(&f.Reader)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	r.c = f
+	return r, nil
+}
+
+// NewReader returns a reader over the given database data, in the current
+// or in the legacy format.
+func NewReader(r *bufio.Reader) (*Reader, error) {
+	b, err := r.Peek(len(magic) + 2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(magic)) {
+		return newLegacyReader(r), nil
+	}
+	if len(b) < len(magic)+2 {
+		return nil, fmt.Errorf("truncated database header")
+	}
+	ver := int(binary.LittleEndian.Uint16(b[len(magic):]))
+	if ver > Version {
+		return nil, fmt.Errorf("database format version %d is newer than "+
+			"the supported version %d", ver, Version)
+	}
+	r.Discard(len(b))
+	z, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	d := gob.NewDecoder(z)
+	if ver == 1 {
+		r, err := newV1Reader(d)
+		if err != nil {
+			z.Close()
+			return nil, err
+		}
+		r.z = z
+		return r, nil
+	}
+	h := &Header{}
+	if err := d.Decode(h); err != nil {
+		z.Close()
+		return nil, fmt.Errorf("bad database header: %w", err)
+	}
+	n := 0
+	return &Reader{Header: h, Version: ver, z: z,
+		next: func() (*Contig, error) {
+			// Stop before the index, if any.
+			if h.NContigs > 0 && n == h.NContigs {
+				return nil, io.EOF
+			}
+			n++
+			c := &Contig{}
+			if err := d.Decode(c); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}}, nil
+}
+
+// Returns a reader over the legacy JSON-lines format.
+func newLegacyReader(r io.Reader) *Reader {
+	type entry struct {
+		OK      int
+		All     int
+		Name    string
+		Buckets struct {
+			Buckets []int
+			OK      []int
+		}
+	}
+	d := json.NewDecoder(r)
+	return &Reader{next: func() (*Contig, error) {
+		var e entry
+		if err := d.Decode(&e); err != nil {
+			return nil, err
+		}
+		return &Contig{Name: e.Name, Buckets: e.Buckets.Buckets,
+			Profiles: []Profile{{All: e.All, OK: e.OK,
+				BucketOK: e.Buckets.OK}}}, nil
+	}}
+}
+
+// Iter iterates over the contigs in the database.
+func (r *Reader) Iter() iter.Seq2[*Contig, error] {
+	return func(yield func(*Contig, error) bool) {
+		for {
+			c, err := r.next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(c, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Close closes the reader and the underlying file, if opened with Open.
+func (r *Reader) Close() error {
+	if r.z != nil {
+		r.z.Close()
+	}
+	if r.c != nil {
+		return r.c.Close()
+	}
+	return nil
+}
+
+// MissingParts returns the part numbers out of 1..nparts that are not in
+// parts, in ascending order.
+func MissingParts(parts []int, nparts int) []int {
+	have := make([]bool, nparts+1)
+	for _, p := range parts {
+		if p >= 1 && p <= nparts {
+			have[p] = true
+		}
+	}
+	var missing []int
+	for p := 1; p <= nparts; p++ {
+		if !have[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
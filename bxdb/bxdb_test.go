@@ -0,0 +1,236 @@
+package bxdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fluhus/bundy/samfile"
+	"github.com/klauspost/compress/zstd"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	h := &Header{Aligner: "bowtie2", ReadLens: []int{75, 100}, ReadStep: 4,
+		BucketSize: 1000, MinQual: 2, RefChecksum: "abc", Part: 2, NParts: 3}
+	contigs := []*Contig{
+		{Name: "a", Profiles: []Profile{
+			{All: 100, OK: 80, BucketOK: []int{80}},
+			{All: 96, OK: 84, BucketOK: []int{84}},
+		}},
+		{Name: "b", Buckets: []int{1000, 2000}, Profiles: []Profile{
+			{All: 3000, OK: 2000, BucketOK: []int{600, 700, 700}},
+			{All: 2996, OK: 2100, BucketOK: []int{700, 700, 700}},
+		}},
+	}
+	buf := &bufferCloser{}
+	w, err := NewWriter(buf, h)
+	if err != nil {
+		t.Fatalf("NewWriter(...) failed: %v", err)
+	}
+	for _, c := range contigs {
+		if err := w.Write(c); err != nil {
+			t.Fatalf("Write(%v) failed: %v", c, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	data := bytes.Clone(buf.Bytes())
+	r, err := NewReader(bufio.NewReader(&buf.Buffer))
+	if err != nil {
+		t.Fatalf("NewReader(...) failed: %v", err)
+	}
+	if r.Version != Version {
+		t.Errorf("Version=%v, want %v", r.Version, Version)
+	}
+	if !reflect.DeepEqual(r.Header, h) {
+		t.Errorf("Header=%v, want %v", r.Header, h)
+	}
+	var got []*Contig
+	for c, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter() failed: %v", err)
+		}
+		got = append(got, c)
+	}
+	if !reflect.DeepEqual(got, contigs) {
+		t.Errorf("Iter()=%v, want %v", got, contigs)
+	}
+
+	// Version 2 has the same layout.
+	binary.LittleEndian.PutUint16(data[len(magic):], 2)
+	r, err = NewReader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("NewReader(v2) failed: %v", err)
+	}
+	if r.Version != 2 || !reflect.DeepEqual(r.Header, h) {
+		t.Errorf("NewReader(v2)=%v,%v, want 2,%v", r.Version, r.Header, h)
+	}
+}
+
+func TestV1(t *testing.T) {
+	buf := &bufferCloser{}
+	buf.Write(binary.LittleEndian.AppendUint16([]byte(magic), 1))
+	z, _ := zstd.NewWriter(buf)
+	e := gob.NewEncoder(z)
+	e.Encode(&headerV1{ReadLen: 100, Part: 1, NParts: 2})
+	e.Encode(&contigV1{Name: "a", All: 30, OK: 20, Buckets: []int{15},
+		BucketOK: []int{8, 12}})
+	z.Close()
+
+	wantH := &Header{ReadLens: []int{100}, Part: 1, NParts: 2}
+	want := []*Contig{{Name: "a", Buckets: []int{15},
+		Profiles: []Profile{{All: 30, OK: 20, BucketOK: []int{8, 12}}}}}
+	r, err := NewReader(bufio.NewReader(&buf.Buffer))
+	if err != nil {
+		t.Fatalf("NewReader(...) failed: %v", err)
+	}
+	if !reflect.DeepEqual(r.Header, wantH) {
+		t.Errorf("Header=%v, want %v", r.Header, wantH)
+	}
+	var got []*Contig
+	for c, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter() failed: %v", err)
+		}
+		got = append(got, c)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Iter()=%v, want %v", got, want)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	input := `{"name":"a","all":100,"ok":80,"buckets":{"Buckets":null,"OK":[80]}}
+{"name":"b","all":30,"ok":20,"buckets":{"Buckets":[15],"OK":[8,12]}}
+`
+	want := []*Contig{
+		{Name: "a", Profiles: []Profile{{All: 100, OK: 80, BucketOK: []int{80}}}},
+		{Name: "b", Buckets: []int{15},
+			Profiles: []Profile{{All: 30, OK: 20, BucketOK: []int{8, 12}}}},
+	}
+	r, err := NewReader(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatalf("NewReader(...) failed: %v", err)
+	}
+	if r.Header != nil {
+		t.Errorf("Header=%v, want nil", r.Header)
+	}
+	var got []*Contig
+	for c, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter() failed: %v", err)
+		}
+		got = append(got, c)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Iter()=%v, want %v", got, want)
+	}
+}
+
+func TestRefChecksum(t *testing.T) {
+	a := []samfile.Ref{{Name: "x", Len: 10}, {Name: "y", Len: 20}}
+	b := []samfile.Ref{{Name: "y", Len: 20}, {Name: "x", Len: 10}}
+	c := []samfile.Ref{{Name: "x", Len: 10}, {Name: "y", Len: 21}}
+	if RefChecksum(a) != RefChecksum(b) {
+		t.Errorf("RefChecksum depends on order")
+	}
+	if RefChecksum(a) == RefChecksum(c) {
+		t.Errorf("RefChecksum ignores lengths")
+	}
+}
+
+func TestMissingParts(t *testing.T) {
+	got := MissingParts([]int{4, 1, 2}, 6)
+	want := []int{3, 5, 6}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingParts(...)=%v, want %v", got, want)
+	}
+	if got := MissingParts([]int{1}, 1); got != nil {
+		t.Errorf("MissingParts([1], 1)=%v, want nil", got)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	h := &Header{Aligner: "bowtie2", ReadLens: []int{100}, Part: 1, NParts: 1}
+	contigs := map[string]*Contig{}
+	for _, name := range []string{"c", "a", "b"} {
+		contigs[name] = &Contig{Name: name, Buckets: []int{1000},
+			Profiles: []Profile{{All: 2000, OK: 1500,
+				BucketOK: []int{700, 800}}}}
+	}
+	file := filepath.Join(t.TempDir(), "db")
+	if err := WriteFile(file, h, contigs); err != nil {
+		t.Fatalf("WriteFile(...) failed: %v", err)
+	}
+
+	x, err := OpenIndex(file)
+	if err != nil {
+		t.Fatalf("OpenIndex(...) failed: %v", err)
+	}
+	defer x.Close()
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(x.Names(), want) {
+		t.Errorf("Names()=%v, want %v", x.Names(), want)
+	}
+	if x.Header.Aligner != h.Aligner || x.Header.NContigs != 3 {
+		t.Errorf("Header=%+v, want aligner %q and 3 contigs", x.Header,
+			h.Aligner)
+	}
+	for _, name := range []string{"c", "a", "b"} {
+		got, err := x.Contig(name)
+		if err != nil {
+			t.Fatalf("Contig(%q) failed: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, contigs[name]) {
+			t.Errorf("Contig(%q)=%v, want %v", name, got, contigs[name])
+		}
+	}
+	if got, err := x.Contig("d"); got != nil || err != nil {
+		t.Errorf("Contig(d)=%v,%v, want nil,nil", got, err)
+	}
+
+	// Sequential reading stops before the index.
+	r, err := Open(file)
+	if err != nil {
+		t.Fatalf("Open(...) failed: %v", err)
+	}
+	defer r.Close()
+	n := 0
+	for _, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter() failed: %v", err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("Iter() returned %v contigs, want 3", n)
+	}
+
+	// Files without an index.
+	file = filepath.Join(t.TempDir(), "part")
+	w, err := Create(file, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(contigs["a"])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenIndex(file); err == nil {
+		t.Errorf("OpenIndex(part) succeeded, want error")
+	}
+}
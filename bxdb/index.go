@@ -0,0 +1,204 @@
+package bxdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Marks the end of an indexed database file.
+const indexTag = "BXINDEX\x00"
+
+// Positions of the contigs in an indexed database file.
+//
+// Each contig of an indexed file starts a new zstd frame, except the first
+// one, which shares its frame with the header. The index follows the last
+// frame, and is followed by its length and indexTag.
+type index struct {
+	Names   []string // Contig names, in file order.
+	Offsets []int64  // Start of each contig's frame.
+	End     int64    // End of the last frame.
+}
+
+// Counts the bytes written to a writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Ends the current frame, unless this is the first contig, and adds the
+// contig to the index.
+func (w *Writer) startFrame(name string) error {
+	if w.n == 0 {
+		w.idx.Offsets = append(w.idx.Offsets, int64(len(magic)+2))
+	} else {
+		if err := w.z.Close(); err != nil {
+			return err
+		}
+		w.z.Reset(w.cw)
+		w.idx.Offsets = append(w.idx.Offsets, w.cw.n)
+	}
+	w.idx.Names = append(w.idx.Names, name)
+	return nil
+}
+
+// Writes the index after the last frame.
+func (w *Writer) writeIndex() error {
+	w.idx.End = w.cw.n
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(w.idx); err != nil {
+		return err
+	}
+	b := binary.LittleEndian.AppendUint64(buf.Bytes(), uint64(buf.Len()))
+	b = append(b, indexTag...)
+	_, err := w.cw.Write(b)
+	return err
+}
+
+// An Index reads single contigs from an indexed database file, without
+// reading the rest of the file.
+type Index struct {
+	Header *Header
+
+	f   *os.File
+	idx *index
+	pos map[string]int
+}
+
+// OpenIndex opens an indexed database file, created by CreateIndexed.
+func OpenIndex(file string) (*Index, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	x, err := newIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return x, nil
+}
+
+// Reads the index and the header of the given file.
+func newIndex(f *os.File) (*Index, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	tail := make([]byte, 8+len(indexTag))
+	if size < int64(len(tail)) {
+		return nil, fmt.Errorf("file has no index")
+	}
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return nil, err
+	}
+	if string(tail[8:]) != indexTag {
+		return nil, fmt.Errorf("file has no index")
+	}
+	n := int64(binary.LittleEndian.Uint64(tail))
+	start := size - int64(len(tail)) - n
+	if n < 0 || start < 0 {
+		return nil, fmt.Errorf("bad index size: %v", n)
+	}
+	idx := &index{}
+	if err := gob.NewDecoder(io.NewSectionReader(f, start, n)).
+		Decode(idx); err != nil {
+		return nil, fmt.Errorf("bad index: %w", err)
+	}
+	if len(idx.Offsets) != len(idx.Names) {
+		return nil, fmt.Errorf("bad index: %v names and %v offsets",
+			len(idx.Names), len(idx.Offsets))
+	}
+
+	r, err := NewReader(bufio.NewReader(io.NewSectionReader(f, 0, idx.End)))
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	if r.Header == nil {
+		return nil, fmt.Errorf("file has no header")
+	}
+
+	pos := make(map[string]int, len(idx.Names))
+	for i, name := range idx.Names {
+		pos[name] = i
+	}
+	return &Index{Header: r.Header, f: f, idx: idx, pos: pos}, nil
+}
+
+// Names returns the names of the contigs, in file order.
+func (x *Index) Names() []string {
+	return x.idx.Names
+}
+
+// Contig reads the contig with the given name. Returns nil if there is no
+// such contig.
+func (x *Index) Contig(name string) (*Contig, error) {
+	i, ok := x.pos[name]
+	if !ok {
+		return nil, nil
+	}
+	// The first frame is needed for the gob type information.
+	z0, err := x.frame(0)
+	if err != nil {
+		return nil, err
+	}
+	defer z0.Close()
+	r := io.Reader(z0)
+	if i > 0 {
+		zi, err := x.frame(i)
+		if err != nil {
+			return nil, err
+		}
+		defer zi.Close()
+		r = io.MultiReader(z0, zi)
+	}
+	d := gob.NewDecoder(r)
+	if err := d.Decode(&Header{}); err != nil {
+		return nil, err
+	}
+	c := &Contig{}
+	if err := d.Decode(c); err != nil {
+		return nil, err
+	}
+	if i > 0 {
+		c = &Contig{}
+		if err := d.Decode(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.Name != name {
+		return nil, fmt.Errorf("bad index: found contig %q instead of %q",
+			c.Name, name)
+	}
+	return c, nil
+}
+
+// Returns a decompressor of the i'th contig's frame.
+func (x *Index) frame(i int) (*zstd.Decoder, error) {
+	end := x.idx.End
+	if i+1 < len(x.idx.Offsets) {
+		end = x.idx.Offsets[i+1]
+	}
+	start := x.idx.Offsets[i]
+	return zstd.NewReader(io.NewSectionReader(x.f, start, end-start),
+		zstd.WithDecoderConcurrency(1))
+}
+
+// Close closes the underlying file.
+func (x *Index) Close() error {
+	return x.f.Close()
+}
@@ -0,0 +1,104 @@
+package bxdb
+
+import (
+	"fmt"
+
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Max number of names to print in error messages.
+const maxNames = 10
+
+// ReadParts reads the contigs of all the given part files, and checks that
+// the parts are complete and consistent. Fails on duplicate contigs.
+func ReadParts(files []string) (*Header, map[string]*Contig, error) {
+	var h *Header
+	contigs := map[string]*Contig{}
+	contigFile := map[string]string{}
+	parts := map[int]string{}
+	var dups []string
+
+	for _, file := range files {
+		r, err := Open(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.Header == nil {
+			r.Close()
+			return nil, nil, fmt.Errorf("%s: legacy format, "+
+				"convert it with bxconvert first", file)
+		}
+		if h == nil {
+			hh := *r.Header
+			h = &hh
+		} else if err := h.SameBuild(r.Header); err != nil {
+			r.Close()
+			return nil, nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if other, ok := parts[r.Header.Part]; ok {
+			r.Close()
+			return nil, nil, fmt.Errorf("%s and %s are both part %d",
+				other, file, r.Header.Part)
+		}
+		parts[r.Header.Part] = file
+
+		for c, err := range r.Iter() {
+			if err != nil {
+				r.Close()
+				return nil, nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if other, ok := contigFile[c.Name]; ok {
+				dups = append(dups, fmt.Sprintf("%s (%s, %s)",
+					c.Name, other, file))
+				continue
+			}
+			contigs[c.Name] = c
+			contigFile[c.Name] = file
+		}
+		r.Close()
+	}
+
+	if len(dups) > 0 {
+		return nil, nil, fmt.Errorf("%d duplicate contigs: %v",
+			len(dups), shorten(dups))
+	}
+	if missing := MissingParts(maps.Keys(parts), h.NParts); len(missing) > 0 {
+		return nil, nil, fmt.Errorf("%d of %d parts are missing: %v",
+			len(missing), h.NParts, shorten(missing))
+	}
+	return h, contigs, nil
+}
+
+// WriteFile writes an indexed database with the given contigs, sorted by
+// name. Single contigs can then be read with OpenIndex.
+func WriteFile(file string, h *Header, contigs map[string]*Contig) error {
+	hh := *h
+	hh.NContigs = len(contigs)
+	w, err := CreateIndexed(file, &hh)
+	if err != nil {
+		return err
+	}
+	for _, name := range snm.Sorted(maps.Keys(contigs)) {
+		if err := w.Write(contigs[name]); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Merge merges the given part files into a single database file.
+func Merge(files []string, outFile string) error {
+	h, contigs, err := ReadParts(files)
+	if err != nil {
+		return err
+	}
+	h.Part, h.NParts = 1, 1
+	return WriteFile(outFile, h, contigs)
+}
+
+// Returns the first few elements of s, for printing.
+func shorten[T any](s []T) []T {
+	return s[:min(len(s), maxNames)]
+}
@@ -0,0 +1,54 @@
+package bxdb
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// Header of format version 1, with a single read length.
+type headerV1 struct {
+	Aligner     string
+	ReadLen     int
+	ReadStep    int
+	BucketSize  int
+	MinQual     int
+	RefChecksum string
+	Part        int
+	NParts      int
+}
+
+// Contig of format version 1, with a single profile.
+type contigV1 struct {
+	Name     string
+	All      int
+	OK       int
+	Buckets  []int
+	BucketOK []int
+}
+
+// Returns a reader that converts version 1 data to the current types.
+func newV1Reader(d *gob.Decoder) (*Reader, error) {
+	h1 := &headerV1{}
+	if err := d.Decode(h1); err != nil {
+		return nil, fmt.Errorf("bad database header: %w", err)
+	}
+	h := &Header{
+		Aligner:     h1.Aligner,
+		ReadLens:    []int{h1.ReadLen},
+		ReadStep:    h1.ReadStep,
+		BucketSize:  h1.BucketSize,
+		MinQual:     h1.MinQual,
+		RefChecksum: h1.RefChecksum,
+		Part:        h1.Part,
+		NParts:      h1.NParts,
+	}
+	return &Reader{Header: h, Version: 1, next: func() (*Contig, error) {
+		c := &contigV1{}
+		if err := d.Decode(c); err != nil {
+			return nil, err
+		}
+		return &Contig{Name: c.Name, Buckets: c.Buckets,
+			Profiles: []Profile{{All: c.All, OK: c.OK,
+				BucketOK: c.BucketOK}}}, nil
+	}}, nil
+}
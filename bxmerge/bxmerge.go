@@ -0,0 +1,115 @@
+// Merges bundyx part files into a single indexed database, with the contigs
+// sorted by name, and checks it against the reference.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/bundy/bxdb"
+	"github.com/fluhus/bundy/common"
+	"github.com/fluhus/bundy/samfile"
+	"github.com/fluhus/gostuff/sets"
+)
+
+// Max number of names to print in messages.
+const maxNames = 10
+
+var (
+	inGlob  = flag.String("i", "", "Input bundyx part files glob pattern")
+	outFile = flag.String("o", "", "Output database file")
+	faGlob  = flag.String("r", "", "Reference fasta files glob pattern, for checking for missing contigs")
+)
+
+func main() {
+	flag.Parse()
+	files := bxdb.Glob(*inGlob)
+	if len(files) == 0 {
+		common.Die(fmt.Errorf("no input files found (-i)"))
+	}
+	if *outFile == "" {
+		common.Die(fmt.Errorf("no output file (-o)"))
+	}
+	if slices.Contains(files, *outFile) {
+		common.Die(fmt.Errorf("output file matches the input pattern"))
+	}
+	faFiles, _ := filepath.Glob(*faGlob)
+	if len(faFiles) == 0 {
+		common.Die(fmt.Errorf("no reference files found (-r)"))
+	}
+
+	fmt.Println("Reading", len(files), "parts")
+	h, contigs, err := bxdb.ReadParts(files)
+	common.Die(err)
+	fmt.Println("Found", len(contigs), "contigs")
+
+	fmt.Println("Writing")
+	h.Part, h.NParts = 1, 1
+	common.Die(bxdb.WriteFile(*outFile, h, contigs))
+
+	fmt.Println("Checking against reference")
+	x, err := bxdb.OpenIndex(*outFile)
+	common.Die(err)
+	err = checkFasta(faFiles, x)
+	x.Close()
+	if err != nil {
+		os.Remove(*outFile)
+		common.Die(err)
+	}
+	fmt.Println("Wrote to:", *outFile)
+}
+
+// Checks that the contigs of the merged database match the sequences in
+// the reference fasta files.
+func checkFasta(files []string, x *bxdb.Index) error {
+	contigs := sets.Of(x.Names()...)
+	names := sets.Set[string]{}
+	var refs []samfile.Ref
+	var missing []string
+	for _, file := range files {
+		for fa, err := range fasta.File(file) {
+			if err != nil {
+				return err
+			}
+			name := string(fa.Name)
+			if i := bytes.IndexAny(fa.Name, " \t"); i != -1 {
+				name = name[:i]
+			}
+			names.Add(name)
+			refs = append(refs, samfile.Ref{Name: name, Len: len(fa.Sequence)})
+			if !contigs.Has(name) {
+				missing = append(missing, name)
+			}
+		}
+	}
+	if sum := x.Header.RefChecksum; sum != "" && sum != bxdb.RefChecksum(refs) {
+		return fmt.Errorf("the reference (-r) does not match the one the " +
+			"database was built with")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d of %d reference contigs are missing: %v",
+			len(missing), len(names), shorten(missing))
+	}
+	var extra []string
+	for _, name := range x.Names() {
+		if !names.Has(name) {
+			extra = append(extra, name)
+		}
+	}
+	if len(extra) > 0 {
+		slices.Sort(extra)
+		fmt.Fprintf(os.Stderr, "WARNING: %d contigs are not in the "+
+			"reference: %v\n", len(extra), shorten(extra))
+	}
+	return nil
+}
+
+// Returns the first few elements of s, for printing.
+func shorten[T any](s []T) []T {
+	return s[:min(len(s), maxNames)]
+}
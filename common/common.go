@@ -1,8 +1,13 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 // Die prints the error and exits if the error is non-nil.
@@ -31,3 +36,28 @@ func If[C comparable, T any](cond C, vif T, velse T) T {
 	}
 	return velse
 }
+
+// SignalContext returns a context that is canceled when the program gets
+// SIGINT or SIGTERM. A second signal terminates the program as usual.
+func SignalContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
+
+// ParseInts parses a comma-separated list of integers.
+func ParseInts(s string) ([]int, error) {
+	var result []int
+	for _, f := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, i)
+	}
+	return result, nil
+}
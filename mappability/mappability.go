@@ -0,0 +1,683 @@
+// Package mappability computes the uniqueness and bucketing data for bundy,
+// by mapping k-mers of the reference back to itself.
+package mappability
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/aligner"
+	"github.com/fluhus/bundy/bxdb"
+	"github.com/fluhus/bundy/mask"
+	"github.com/fluhus/bundy/simreads"
+	"github.com/fluhus/gostuff/bits"
+	"github.com/fluhus/gostuff/gnum"
+	"github.com/fluhus/gostuff/hashx"
+	"github.com/fluhus/gostuff/ptimer"
+	"github.com/fluhus/gostuff/sets"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Default settings.
+const (
+	DefaultMinQual    = 2    // Minimal mapping quality for a k-mer to count as unique.
+	DefaultReadStep   = 4    // Distance between consecutive k-mers.
+	DefaultBucketSize = 1000 // Target bucket size, in bases.
+)
+
+// Config holds the settings of a single computation.
+type Config struct {
+	Aligner    string // Aligner name, recorded in the database header.
+	Fast       bool   // Whether the aligner runs in fast mode, recorded in the header.
+	ReadLens   []int  // Lengths of the simulated reads, one profile each.
+	ReadStep   int    // Distance between consecutive k-mers.
+	BucketSize int    // Target bucket size, in bases.
+	Balanced   bool   // Place bucket boundaries so that buckets have similar numbers of unique reads.
+	MinQual    int    // Minimal mapping quality for a k-mer to count as unique.
+	Part       int    // Part number, starting from 1.
+	NParts     int    // Total number of parts.
+	Plan       *Plan  // Assigns sequences to parts. Nil means by name hash.
+
+	// Sequencing errors to add to the simulated reads. Nil means exact
+	// reads. Reads with errors are generated by this package rather than
+	// by the aligner.
+	Errors *simreads.ErrorModel
+
+	// Insert size distribution of simulated read pairs. If not nil, a
+	// paired-end profile is computed for each read length, in addition to
+	// the single-end ones.
+	Insert *simreads.InsertSize
+
+	// Regions whose reads do not count as unique. Nil means no masking.
+	Mask *mask.Mask
+
+	Quiet bool // Don't print progress.
+}
+
+// DefaultConfig returns the default settings, for a single part.
+func DefaultConfig() Config {
+	return Config{
+		ReadLens:   []int{100},
+		ReadStep:   DefaultReadStep,
+		BucketSize: DefaultBucketSize,
+		MinQual:    DefaultMinQual,
+		Part:       1,
+		NParts:     1,
+	}
+}
+
+// Validate returns an error if a setting is invalid.
+func (c *Config) Validate() error {
+	if len(c.ReadLens) == 0 {
+		return fmt.Errorf("no read lengths")
+	}
+	for _, rl := range c.ReadLens {
+		if rl <= 0 {
+			return fmt.Errorf("bad read length: %d", rl)
+		}
+	}
+	if c.ReadStep <= 0 {
+		return fmt.Errorf("bad read step: %d", c.ReadStep)
+	}
+	if c.BucketSize <= 0 {
+		return fmt.Errorf("bad bucket size: %d", c.BucketSize)
+	}
+	if c.MinQual < 0 || c.MinQual > 255 {
+		return fmt.Errorf("bad mapping quality threshold: %d", c.MinQual)
+	}
+	if c.NParts < 1 || c.Part < 1 || c.Part > c.NParts {
+		return fmt.Errorf("bad part: %d/%d", c.Part, c.NParts)
+	}
+	if c.Plan != nil && c.Plan.NParts != c.NParts {
+		return fmt.Errorf("plan has %d parts but running with %d",
+			c.Plan.NParts, c.NParts)
+	}
+	if c.Errors != nil {
+		if err := c.Errors.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Insert != nil {
+		return c.Insert.Validate()
+	}
+	return nil
+}
+
+// Compute maps the k-mers of the contigs in the given fasta files that
+// belong to the configured part, and writes the result to outFile.
+// Mapping is done once per profile, meaning per read length and, if
+// configured, again per read length with read pairs.
+func Compute(ctx context.Context, al aligner.Aligner, fastas []string,
+	outFile string, c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	h := c.header()
+	bk := newBuckets(c)
+	var counts []*kmerCounts
+	for i, rl := range h.ReadLens {
+		paired := h.IsPaired(i)
+		if !c.Quiet {
+			if paired {
+				fmt.Println("Mapping read pairs of length", rl)
+			} else {
+				fmt.Println("Mapping read length", rl)
+			}
+		}
+		fa := makeFasta(fastas, c, bk)
+		var sams iter.Seq2[*sam.SAM, error]
+		switch {
+		case paired:
+			sams = al.MapIntReader(ctx,
+				simreads.Pairs(fa, rl, c.ReadStep, c.Insert, c.Errors))
+		case c.Errors != nil:
+			sams = al.MapReader(ctx,
+				simreads.NoisyKmers(fa, rl, c.ReadStep, c.Errors))
+		default:
+			sams = al.MapKmers(ctx, fa, rl, c.ReadStep)
+		}
+		kc, err := countKmers(sams, c, paired, bk)
+		if err != nil {
+			return err
+		}
+		counts = append(counts, kc)
+	}
+	if sh := al.Header(); sh != nil {
+		h.RefChecksum = bxdb.RefChecksum(sh.Refs)
+	}
+	return writeDB(outFile, h, counts, bk, c)
+}
+
+// ComputeParts runs Compute on all the configured number of parts, using the
+// given number of workers that each create their own aligner using
+// newAligner. Part i is written to dir/i. Parts that were already written
+// with the same settings are skipped, so an interrupted run can be resumed.
+// Returns the part files.
+func ComputeParts(ctx context.Context, newAligner func() (aligner.Aligner,
+	error), fastas []string, dir string, c *Config, workers int,
+) ([]string, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("bad number of workers: %d", workers)
+	}
+	var files []string
+	var todo []int
+	for p := 1; p <= c.NParts; p++ {
+		file := filepath.Join(dir, fmt.Sprint(p))
+		files = append(files, file)
+		cc := *c
+		cc.Part = p
+		if partDone(file, cc.header()) {
+			fmt.Printf("Part %d/%d already done\n", p, c.NParts)
+			continue
+		}
+		todo = append(todo, p)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for range min(workers, len(todo)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				err := computePart(ctx, newAligner, fastas, files[p-1], c, p)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("part %d: %w", p, err)
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				fmt.Printf("Part %d/%d done\n", p, c.NParts)
+			}
+		}()
+	}
+loop:
+	for _, p := range todo {
+		select {
+		case jobs <- p:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Computes a single part with its own aligner.
+func computePart(ctx context.Context, newAligner func() (aligner.Aligner,
+	error), fastas []string, file string, c *Config, part int) error {
+	al, err := newAligner()
+	if err != nil {
+		return err
+	}
+	cc := *c
+	cc.Part = part
+	cc.Quiet = true
+	return Compute(ctx, al, fastas, file, &cc)
+}
+
+// Returns whether the given part file exists and was built with the
+// settings in h.
+func partDone(file string, h *bxdb.Header) bool {
+	r, err := bxdb.Open(file)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	if r.Header == nil || r.Header.Part != h.Part {
+		return false
+	}
+	hh := *r.Header
+	hh.RefChecksum = h.RefChecksum
+	return h.SameBuild(&hh) == nil
+}
+
+// Returns the database header for this configuration,
+// without a reference checksum.
+func (c *Config) header() *bxdb.Header {
+	plan, errs, ins, msk := "", "", "", ""
+	if c.Plan != nil {
+		plan = c.Plan.Checksum()
+	}
+	if c.Mask != nil {
+		msk = c.Mask.Checksum()
+	}
+	if c.Errors != nil {
+		errs = c.Errors.String()
+	}
+	readLens := c.ReadLens
+	var paired []bool
+	if c.Insert != nil {
+		ins = c.Insert.String()
+		readLens = slices.Concat(c.ReadLens, c.ReadLens)
+		paired = make([]bool, len(readLens))
+		for i := len(c.ReadLens); i < len(paired); i++ {
+			paired[i] = true
+		}
+	}
+	return &bxdb.Header{
+		PlanChecksum: plan,
+		SimErrors:    errs,
+		Paired:       paired,
+		InsertSize:   ins,
+		MaskChecksum: msk,
+		Aligner:      c.Aligner,
+		Fast:         c.Fast,
+		ReadLens:     readLens,
+		ReadStep:     c.ReadStep,
+		BucketSize:   c.BucketSize,
+		Balanced:     c.Balanced,
+		MinQual:      c.MinQual,
+		Part:         c.Part,
+		NParts:       c.NParts,
+	}
+}
+
+// Generates a fasta subset stream from the input genomes, registering the
+// sequences in bk.
+func makeFasta(files []string, c *Config, bk *buckets) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		for _, f := range files {
+			if err := makeFastaFile(f, w, c, bk); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.Close()
+	}()
+	return r
+}
+
+// Writes the sequences of the given part from the given fasta to the given
+// writer.
+func makeFastaFile(file string, w io.Writer, c *Config, bk *buckets,
+) error {
+	for fa, err := range fasta.File(file) {
+		if err != nil {
+			return err
+		}
+		if c.Plan != nil {
+			p, ok := c.Plan.Parts[string(fa.Name)]
+			if !ok {
+				return fmt.Errorf("sequence %q is not in the partition plan",
+					fa.Name)
+			}
+			if p != c.Part {
+				continue
+			}
+		} else if !InPart(fa.Name, c.Part, c.NParts) {
+			continue
+		}
+		// Registered before writing, so that it is known before the aligner
+		// reports any of the sequence's reads.
+		bk.add(seqName(fa.Name), fa.Sequence)
+		txt, _ := fa.MarshalText()
+		if _, err := w.Write(txt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InPart returns whether the contig with the given name belongs to the
+// given part, when partitioning by name hash.
+func InPart(name []byte, part, nparts int) bool {
+	return hashx.Bytes(name)%uint64(nparts) == uint64(part-1)
+}
+
+// Mapping results of a single profile.
+type kmerCounts struct {
+	all      map[string]int   // Simulated reads per contig.
+	ok       map[string]int   // Uniquely mapped reads per contig.
+	bucketOK map[string][]int // Uniquely mapped reads per bucket per contig.
+	mates    int              // Reads per simulated fragment.
+}
+
+// Aggregates mapping results of a single profile. For read pairs, a mate
+// counts as unique only if it is mapped as part of a proper pair.
+// Reads mapped to masked positions do not count as unique.
+// Unique reads are counted directly into buckets. For single reads, the
+// buckets count distinct positions, tracked in a bitmap per contig.
+func countKmers(sams iter.Seq2[*sam.SAM, error], c *Config, paired bool,
+	bk *buckets) (*kmerCounts, error) {
+	all := map[string]int{}
+	ok := map[string]int{}
+	bucketOK := map[string][]int{}
+	seen := map[string][]byte{}
+
+	var pt *ptimer.Timer
+	if !c.Quiet {
+		pt = ptimer.NewMessage("loading reference")
+	}
+	fre := regexp.MustCompile(`^(.*)_(\d+)$`)
+
+	for sm, err := range sams {
+		if err != nil {
+			return nil, err
+		}
+		if pt != nil {
+			if pt.N == 0 {
+				pt.Done()
+				pt = ptimer.NewMessage("{} reads")
+				pt.Inc()
+			}
+			pt.Inc()
+		}
+
+		// Minimap2 reports supplementary alignments even without
+		// secondary ones.
+		if sm.Flag&(sam.FlagSecondary|sam.FlagSupplementary) != 0 {
+			continue
+		}
+
+		var splt []string
+		match := fre.FindStringSubmatch(sm.Qname)
+		splt = []string{match[2], match[1]}
+		rname := splt[1]
+		all[rname]++
+		if sm.Flag&sam.FlagUnmapped != 0 {
+			continue
+		}
+		if sm.Mapq < c.MinQual {
+			continue
+		}
+		if paired && sm.Flag&sam.FlagEach == 0 {
+			continue
+		}
+		if c.Mask != nil && c.Mask.Has(sm.Rname, sm.Pos-1) {
+			continue
+		}
+
+		ok[rname]++
+		sb, err := bk.get(rname)
+		if err != nil {
+			return nil, err
+		}
+		bounds := sb.bounds
+		b := bucketOK[rname]
+		if b == nil {
+			b = make([]int, len(bounds)+1)
+			bucketOK[rname] = b
+		}
+		if !paired && !firstAt(seen, rname, sm.Pos, sb.len) {
+			continue
+		}
+		b[sort.SearchInts(bounds, sm.Pos)]++
+	}
+	if pt != nil {
+		pt.Done()
+	}
+
+	mates := 1
+	if paired {
+		mates = 2
+	}
+	mulByReadStep(all, c.ReadStep)
+	mulByReadStep(ok, c.ReadStep)
+	return &kmerCounts{all, ok, bucketOK, mates}, nil
+}
+
+// Writes the data for bundy. Contigs with no reads in some profile, like
+// contigs shorter than its read length, get a zero profile there.
+// The first profile drives the bucket layout: with balanced buckets, the
+// fine buckets are merged according to its unique reads.
+func writeDB(outFile string, h *bxdb.Header, counts []*kmerCounts,
+	bk *buckets, c *Config) error {
+	w, err := bxdb.Create(outFile, h)
+	if err != nil {
+		return err
+	}
+	names := sets.Set[string]{}
+	for _, kc := range counts {
+		names.Add(maps.Keys(kc.all)...)
+	}
+	for _, k := range snm.Sorted(maps.Keys(names)) {
+		sb, err := bk.get(k)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		bounds, coarse := sb.bounds, sb.bounds
+		if c.Balanced {
+			ok := counts[0].contigBucketOK(k, len(bounds)+1)
+			coarse = balancedBounds(bounds, ok, bk.count(sb))
+		}
+		contig := &bxdb.Contig{Name: k, Buckets: coarse,
+			BucketGC: gcFractions(mergeBuckets(bounds, coarse, sb.gc),
+				mergeBuckets(bounds, coarse, sb.acgt))}
+		for _, kc := range counts {
+			bucketOK := mergeBuckets(bounds, coarse, kc.bucketOK[k])
+			for i := range bucketOK {
+				bucketOK[i] = bucketOK[i] * c.ReadStep / kc.mates
+			}
+			contig.Profiles = append(contig.Profiles, bxdb.Profile{
+				All: kc.all[k] / kc.mates, OK: kc.ok[k] / kc.mates,
+				BucketOK: bucketOK,
+			})
+		}
+		if err := w.Write(contig); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Marks the given position of the named contig in seen, a bitmap per
+// contig. Returns false if it was already marked.
+func firstAt(seen map[string][]byte, name string, pos, seqLen int) bool {
+	s := seen[name]
+	if n := max(pos, seqLen)/8 + 1; len(s) < n {
+		s = append(s, make([]byte, n-len(s))...)
+		seen[name] = s
+	}
+	if bits.Get(s, pos) == 1 {
+		return false
+	}
+	bits.Set1(s, pos)
+	return true
+}
+
+// Multiplies raw counts by read step to simulate real counts.
+func mulByReadStep(m map[string]int, step int) {
+	for k := range m {
+		m[k] *= step
+	}
+}
+
+// Returns the boundaries of buckets over a contig with the given number of
+// simulated reads.
+func bucketBounds(all, size int) []int {
+	nBuckets := max(1, gnum.Idiv(all, size))
+	var buckets []int
+	for i := 1; i < nBuckets; i++ {
+		buckets = append(buckets, gnum.Idiv(all*i, nBuckets))
+	}
+	return buckets
+}
+
+// Returns a subset of the given fine bucket boundaries, that splits a contig
+// into n buckets with similar numbers of unique reads, according to ok, the
+// unique reads in each fine bucket. If there are no unique reads, the
+// buckets get similar numbers of fine buckets.
+func balancedBounds(bounds, ok []int, n int) []int {
+	w := ok
+	if gnum.Sum(ok) == 0 {
+		w = snm.Slice(len(ok), func(i int) int { return 1 })
+	}
+	total := gnum.Sum(w)
+	var result []int
+	cum, j := 0, 1
+	for i, x := range w[:len(w)-1] {
+		cum += x
+		if j < n && cum*n >= total*j {
+			result = append(result, bounds[i])
+			for j < n && cum*n >= total*j {
+				j++
+			}
+		}
+	}
+	return result
+}
+
+// Returns the unique read counts in the n buckets of the given contig,
+// zeros if it has none.
+func (kc *kmerCounts) contigBucketOK(name string, n int) []int {
+	if ok := kc.bucketOK[name]; ok != nil {
+		return ok
+	}
+	return make([]int, n)
+}
+
+// Returns the number of simulated reads of length k over a sequence of the
+// given length, multiplied by step like the counts.
+func simulatedReads(seqLen, k, step int) int {
+	return (max(seqLen-k, 0)/step + 1) * step
+}
+
+// Bucket boundaries of the mapped sequences, shared by all profiles.
+// Boundaries are set by the sequence length and the first read length,
+// so they are known before any read is counted. With balanced buckets,
+// reads are counted into fine buckets that are merged at the end.
+// Safe for concurrent use.
+type buckets struct {
+	mu   sync.Mutex
+	seqs map[string]*seqBuckets
+	k    int // Read length.
+	step int // Read step.
+	size int // Bucket size.
+	fine int // Counted bucket size.
+}
+
+// Bucket information of a single sequence.
+type seqBuckets struct {
+	len    int   // Sequence length.
+	bounds []int // Fine bucket boundaries.
+	gc     []int // G and C bases per fine bucket.
+	acgt   []int // A, C, G and T bases per fine bucket.
+}
+
+// Number of fine buckets per bucket, when balancing buckets.
+const balanceRes = 10
+
+// Returns an empty bucket tracker for the given configuration.
+func newBuckets(c *Config) *buckets {
+	fine := c.BucketSize
+	if c.Balanced {
+		fine = max(1, fine/balanceRes)
+	}
+	return &buckets{seqs: map[string]*seqBuckets{}, k: c.ReadLens[0],
+		step: c.ReadStep, size: c.BucketSize, fine: fine}
+}
+
+// Registers a sequence that is given to the aligner, and counts its bases
+// per bucket.
+func (b *buckets) add(name string, seq []byte) {
+	b.mu.Lock()
+	_, ok := b.seqs[name]
+	b.mu.Unlock()
+	if ok {
+		return
+	}
+	sb := &seqBuckets{len: len(seq),
+		bounds: bucketBounds(simulatedReads(len(seq), b.k, b.step), b.fine)}
+	sb.gc = make([]int, len(sb.bounds)+1)
+	sb.acgt = make([]int, len(sb.bounds)+1)
+	j := 0
+	for i, c := range seq {
+		// Positions are 1-based, like in SAM.
+		for j < len(sb.bounds) && i+1 > sb.bounds[j] {
+			j++
+		}
+		switch c {
+		case 'G', 'C', 'g', 'c':
+			sb.gc[j]++
+			sb.acgt[j]++
+		case 'A', 'T', 'a', 't':
+			sb.acgt[j]++
+		}
+	}
+	b.mu.Lock()
+	b.seqs[name] = sb
+	b.mu.Unlock()
+}
+
+// Returns the bucket information of the given sequence.
+func (b *buckets) get(name string) (*seqBuckets, error) {
+	b.mu.Lock()
+	sb, ok := b.seqs[name]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("read from an unknown sequence: %q", name)
+	}
+	return sb, nil
+}
+
+// Returns the final number of buckets of the given sequence.
+func (b *buckets) count(sb *seqBuckets) int {
+	return len(bucketBounds(simulatedReads(sb.len, b.k, b.step), b.size)) + 1
+}
+
+// Sums the given counts of fine buckets into the coarse buckets, whose
+// boundaries are a subset of the fine ones.
+func mergeBuckets(fine, coarse, counts []int) []int {
+	result := make([]int, len(coarse)+1)
+	for i, n := range counts {
+		j := len(coarse)
+		if i < len(fine) {
+			j = sort.SearchInts(coarse, fine[i])
+		}
+		result[j] += n
+	}
+	return result
+}
+
+// Returns the GC fraction of each bucket, NaN for buckets with no
+// called bases.
+func gcFractions(gc, acgt []int) []float64 {
+	return snm.Slice(len(gc), func(i int) float64 {
+		if acgt[i] == 0 {
+			return math.NaN()
+		}
+		return float64(gc[i]) / float64(acgt[i])
+	})
+}
+
+// Returns the name of a fasta sequence up to the first whitespace, as
+// aligners report it.
+func seqName(name []byte) string {
+	if i := bytes.IndexAny(name, " \t"); i != -1 {
+		name = name[:i]
+	}
+	return string(name)
+}
@@ -0,0 +1,316 @@
+package mappability
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/aligner"
+	"github.com/fluhus/bundy/bxdb"
+	"github.com/fluhus/bundy/samfile"
+	"github.com/fluhus/gostuff/gnum"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+func TestBuckets(t *testing.T) {
+	buckets := bucketBounds(2500, 1000)
+	if want := []int{833, 1667}; !reflect.DeepEqual(buckets, want) {
+		t.Fatalf("bucketBounds(2500, 1000)=%v, want %v", buckets, want)
+	}
+	for _, test := range []struct{ n, k, want int }{
+		{100, 20, 84}, {103, 20, 84}, {104, 20, 88}, {10, 20, 4},
+	} {
+		if got := simulatedReads(test.n, test.k, 4); got != test.want {
+			t.Errorf("simulatedReads(%v,%v,4)=%v, want %v",
+				test.n, test.k, got, test.want)
+		}
+	}
+}
+
+func TestInPart(t *testing.T) {
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		n := 0
+		for p := 1; p <= 3; p++ {
+			if InPart([]byte(name), p, 3) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("InPart(%q) matched %d parts, want 1", name, n)
+		}
+	}
+}
+
+// Maps each k-mer to where it came from, with full quality.
+type fakeAligner struct {
+	aligner.Aligner
+	calls *atomic.Int32
+}
+
+func (a *fakeAligner) MapKmers(ctx context.Context, fa io.Reader, k, step int,
+) iter.Seq2[*sam.SAM, error] {
+	a.calls.Add(1)
+	return func(yield func(*sam.SAM, error) bool) {
+		for f, err := range fasta.Reader(fa) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for i := 0; i+k <= len(f.Sequence); i += step {
+				if !yield(&sam.SAM{Qname: fmt.Sprintf("%s_%d", f.Name, i),
+					Rname: string(f.Name), Pos: i + 1, Mapq: 40}, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *fakeAligner) Header() *samfile.Header {
+	return nil
+}
+
+func TestComputeParts(t *testing.T) {
+	dir := t.TempDir()
+	fa := filepath.Join(dir, "ref.fa")
+	var names []string
+	txt := ""
+	for i := range 10 {
+		names = append(names, fmt.Sprint("contig", i))
+		txt += fmt.Sprintf(">contig%d\n%s\n", i, strings.Repeat("ACGT", 50))
+	}
+	if err := os.WriteFile(fa, []byte(txt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := &atomic.Int32{}
+	newAligner := func() (aligner.Aligner, error) {
+		return &fakeAligner{calls: calls}, nil
+	}
+	c := DefaultConfig()
+	c.ReadLens = []int{20}
+	c.NParts = 3
+	files, err := ComputeParts(context.Background(), newAligner,
+		[]string{fa}, dir, &c, 2)
+	if err != nil {
+		t.Fatalf("ComputeParts(...) failed: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("aligner called %d times, want 3", calls.Load())
+	}
+	_, contigs, err := bxdb.ReadParts(files)
+	if err != nil {
+		t.Fatalf("ReadParts(%v) failed: %v", files, err)
+	}
+	if got := snm.Sorted(maps.Keys(contigs)); !reflect.DeepEqual(got, names) {
+		t.Errorf("ReadParts(...)=%v, want %v", got, names)
+	}
+	for name, contig := range contigs {
+		p := contig.Profiles[0]
+		if sum := gnum.Sum(p.BucketOK); sum != p.OK || p.OK != p.All {
+			t.Errorf("contig %s: ok=%v all=%v buckets=%v, want all equal",
+				name, p.OK, p.All, sum)
+		}
+	}
+
+	// Resume: remove one part, leaving a partial file as if interrupted.
+	// Only it should be computed again.
+	calls.Store(0)
+	os.Remove(files[1])
+	if err := os.WriteFile(files[1]+".tmp", []byte("BUNDYX"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := bxdb.Glob(filepath.Join(dir, "[0-9]*")); len(got) != 2 {
+		t.Errorf("Glob(...)=%v, want 2 files", got)
+	}
+	if _, err := ComputeParts(context.Background(), newAligner,
+		[]string{fa}, dir, &c, 2); err != nil {
+		t.Fatalf("ComputeParts(...) failed: %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("aligner called %d times, want 1", calls.Load())
+	}
+	got := bxdb.Glob(filepath.Join(dir, "[0-9]*"))
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("Glob(...)=%v, want %v", got, files)
+	}
+	if _, _, err := bxdb.ReadParts(got); err != nil {
+		t.Errorf("ReadParts(%v) failed: %v", got, err)
+	}
+}
+
+func TestCompute_shortContig(t *testing.T) {
+	dir := t.TempDir()
+	fa := filepath.Join(dir, "ref.fa")
+	txt := ">long\n" + strings.Repeat("ACGT", 50) + "\n>short\nACGTACGTACGT\n"
+	if err := os.WriteFile(fa, []byte(txt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.bx")
+	for _, balanced := range []bool{false, true} {
+		c := DefaultConfig()
+		c.Quiet = true
+		c.ReadLens, c.ReadStep, c.Balanced = []int{20, 10}, 1, balanced
+		al := &fakeAligner{calls: &atomic.Int32{}}
+		if err := Compute(context.Background(), al, []string{fa}, out,
+			&c); err != nil {
+			t.Fatalf("Compute(...) failed: %v", err)
+		}
+		_, contigs, err := bxdb.ReadParts([]string{out})
+		if err != nil {
+			t.Fatalf("ReadParts(%v) failed: %v", out, err)
+		}
+		short := contigs["short"]
+		if short == nil {
+			t.Fatalf("Compute(...) balanced=%v: short contig is missing",
+				balanced)
+		}
+		want := []bxdb.Profile{
+			{BucketOK: []int{0}},
+			{All: 3, OK: 3, BucketOK: []int{3}},
+		}
+		if !reflect.DeepEqual(short.Profiles, want) {
+			t.Errorf("Compute(...) balanced=%v: short contig profiles=%v, "+
+				"want %v", balanced, short.Profiles, want)
+		}
+	}
+}
+
+func TestMakePlan(t *testing.T) {
+	fa := filepath.Join(t.TempDir(), "ref.fa")
+	txt := ""
+	for i, n := range []int{50, 100, 30, 60, 40} {
+		txt += fmt.Sprintf(">s%d\n%s\n", i, strings.Repeat("A", n))
+	}
+	if err := os.WriteFile(fa, []byte(txt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := MakePlan([]string{fa}, 2)
+	if err != nil {
+		t.Fatalf("MakePlan(...) failed: %v", err)
+	}
+	wantParts := map[string]int{"s1": 1, "s3": 2, "s0": 2, "s4": 1, "s2": 2}
+	if !reflect.DeepEqual(p.Parts, wantParts) {
+		t.Errorf("MakePlan(...).Parts=%v, want %v", p.Parts, wantParts)
+	}
+	if want := []int{140, 140}; !reflect.DeepEqual(p.Bases, want) {
+		t.Errorf("MakePlan(...).Bases=%v, want %v", p.Bases, want)
+	}
+}
+
+func TestBalancedBounds(t *testing.T) {
+	bounds := []int{10, 20, 30, 40, 50}
+	tests := []struct {
+		ok   []int
+		n    int
+		want []int
+	}{
+		{[]int{5, 5, 5, 5, 5, 5}, 3, []int{20, 40}},
+		{[]int{9, 0, 0, 0, 0, 9}, 2, []int{10}},
+		{[]int{0, 0, 0, 0, 0, 0}, 2, []int{30}},
+		{[]int{1, 2, 3, 4, 5, 6}, 1, nil},
+	}
+	for _, test := range tests {
+		got := balancedBounds(bounds, test.ok, test.n)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("balancedBounds(%v,%v,%v)=%v, want %v",
+				bounds, test.ok, test.n, got, test.want)
+		}
+	}
+}
+
+func TestBucketsGC(t *testing.T) {
+	c := DefaultConfig()
+	c.ReadLens, c.ReadStep, c.BucketSize = []int{1}, 1, 4
+	bk := newBuckets(&c)
+	bk.add("a", []byte("GGCCAATTNN"))
+	sb, err := bk.get("a")
+	if err != nil {
+		t.Fatalf("get(a) failed: %v", err)
+	}
+	if want := []int{3, 7}; !reflect.DeepEqual(sb.bounds, want) {
+		t.Fatalf("bounds=%v, want %v", sb.bounds, want)
+	}
+	got := gcFractions(sb.gc, sb.acgt)
+	if want := []float64{1, 0.25, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gcFractions(...)=%v, want %v", got, want)
+	}
+	merged := mergeBuckets(sb.bounds, []int{7}, sb.gc)
+	if want := []int{4, 0}; !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeBuckets(...)=%v, want %v", merged, want)
+	}
+	if _, err := bk.get("b"); err == nil {
+		t.Errorf("get(b) succeeded, want error")
+	}
+}
+
+func TestCountKmers_supplementary(t *testing.T) {
+	c := DefaultConfig()
+	c.Quiet = true
+	c.ReadLens, c.ReadStep, c.BucketSize = []int{2}, 1, 4
+	bk := newBuckets(&c)
+	bk.add("a", []byte("ACGTACGT"))
+	sams := []*sam.SAM{
+		{Qname: "a_0", Rname: "a", Pos: 1, Mapq: 40},
+		{Qname: "a_0", Rname: "a", Pos: 5, Mapq: 40,
+			Flag: sam.FlagSupplementary},
+		{Qname: "a_1", Rname: "a", Pos: 2, Mapq: 40},
+		{Qname: "a_1", Rname: "a", Pos: 6, Mapq: 40, Flag: sam.FlagSecondary},
+	}
+	it := func(yield func(*sam.SAM, error) bool) {
+		for _, sm := range sams {
+			if !yield(sm, nil) {
+				return
+			}
+		}
+	}
+	kc, err := countKmers(it, &c, false, bk)
+	if err != nil {
+		t.Fatalf("countKmers(...) failed: %v", err)
+	}
+	if kc.all["a"] != 2 || kc.ok["a"] != 2 {
+		t.Errorf("countKmers(...)=all %v ok %v, want 2 and 2",
+			kc.all["a"], kc.ok["a"])
+	}
+}
+
+func TestCountKmers_samePosition(t *testing.T) {
+	c := DefaultConfig()
+	c.Quiet = true
+	c.ReadLens, c.ReadStep, c.BucketSize = []int{2}, 1, 4
+	bk := newBuckets(&c)
+	bk.add("a", []byte("ACGTACGT"))
+	sams := []*sam.SAM{
+		{Qname: "a_0", Rname: "a", Pos: 1, Mapq: 40},
+		{Qname: "a_4", Rname: "a", Pos: 1, Mapq: 40},
+		{Qname: "a_5", Rname: "a", Pos: 6, Mapq: 40},
+	}
+	it := func(yield func(*sam.SAM, error) bool) {
+		for _, sm := range sams {
+			if !yield(sm, nil) {
+				return
+			}
+		}
+	}
+	kc, err := countKmers(it, &c, false, bk)
+	if err != nil {
+		t.Fatalf("countKmers(...) failed: %v", err)
+	}
+	if kc.ok["a"] != 3 {
+		t.Errorf("countKmers(...)=ok %v, want 3", kc.ok["a"])
+	}
+	if got, want := kc.bucketOK["a"], []int{1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("countKmers(...)=buckets %v, want %v", got, want)
+	}
+}
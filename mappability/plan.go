@@ -0,0 +1,134 @@
+package mappability
+
+import (
+	"cmp"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/gostuff/jio"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Plan assigns reference sequences to parts.
+type Plan struct {
+	NParts int            `json:"nparts"`
+	Parts  map[string]int `json:"parts"` // Sequence name to part number, starting from 1.
+	Bases  []int          `json:"bases"` // Total sequence length of each part.
+
+	sum string // Cached checksum.
+}
+
+// MakePlan returns a plan that splits the sequences in the given fasta files
+// into parts of roughly equal total length. Sequences are assigned from
+// longest to shortest, each to the part with the fewest bases so far.
+// The result is deterministic.
+func MakePlan(fastas []string, nparts int) (*Plan, error) {
+	if nparts < 1 {
+		return nil, fmt.Errorf("bad number of parts: %d", nparts)
+	}
+	type seq struct {
+		name string
+		n    int
+	}
+	var seqs []seq
+	for _, f := range fastas {
+		for fa, err := range fasta.File(f) {
+			if err != nil {
+				return nil, err
+			}
+			seqs = append(seqs, seq{string(fa.Name), len(fa.Sequence)})
+		}
+	}
+	slices.SortFunc(seqs, func(a, b seq) int {
+		return cmp.Or(cmp.Compare(b.n, a.n), cmp.Compare(a.name, b.name))
+	})
+
+	p := &Plan{NParts: nparts, Parts: map[string]int{},
+		Bases: make([]int, nparts)}
+	h := &partHeap{bases: p.Bases,
+		parts: snm.Slice(nparts, func(i int) int { return i })}
+	for _, s := range seqs {
+		if _, ok := p.Parts[s.name]; ok {
+			return nil, fmt.Errorf("duplicate sequence: %q", s.name)
+		}
+		i := h.parts[0]
+		p.Parts[s.name] = i + 1
+		p.Bases[i] += s.n
+		heap.Fix(h, 0)
+	}
+	p.sum = p.checksum()
+	return p, nil
+}
+
+// ReadPlan reads a plan from a JSON file.
+func ReadPlan(file string) (*Plan, error) {
+	p := &Plan{}
+	if err := jio.Read(file, p); err != nil {
+		return nil, err
+	}
+	for name, part := range p.Parts {
+		if part < 1 || part > p.NParts {
+			return nil, fmt.Errorf("bad part for %q: %d", name, part)
+		}
+	}
+	p.sum = p.checksum()
+	return p, nil
+}
+
+// Write writes the plan to a JSON file.
+func (p *Plan) Write(file string) error {
+	return jio.Write(file, p)
+}
+
+// Checksum returns a checksum of the sequence-to-part assignment.
+func (p *Plan) Checksum() string {
+	if p.sum != "" {
+		return p.sum
+	}
+	return p.checksum()
+}
+
+// Computes the checksum.
+func (p *Plan) checksum() string {
+	h := sha256.New()
+	for _, name := range snm.Sorted(maps.Keys(p.Parts)) {
+		fmt.Fprintf(h, "%s\t%d\n", name, p.Parts[name])
+	}
+	io.WriteString(h, fmt.Sprint(p.NParts))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// A min-heap of part indexes by their total bases, ties broken by index.
+type partHeap struct {
+	bases []int
+	parts []int
+}
+
+func (h *partHeap) Len() int {
+	return len(h.parts)
+}
+
+func (h *partHeap) Less(i, j int) bool {
+	a, b := h.parts[i], h.parts[j]
+	return cmp.Or(cmp.Compare(h.bases[a], h.bases[b]), cmp.Compare(a, b)) < 0
+}
+
+func (h *partHeap) Swap(i, j int) {
+	h.parts[i], h.parts[j] = h.parts[j], h.parts[i]
+}
+
+func (h *partHeap) Push(x any) {
+	h.parts = append(h.parts, x.(int))
+}
+
+func (h *partHeap) Pop() any {
+	x := h.parts[len(h.parts)-1]
+	h.parts = h.parts[:len(h.parts)-1]
+	return x
+}
@@ -0,0 +1,130 @@
+// Package mask reads BED files of genomic regions to exclude from counting.
+package mask
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Mask holds masked regions per sequence. Positions are 0-based, and ranges
+// are half-open, like in BED files.
+type Mask struct {
+	m map[string][]interval // Sorted and non-overlapping.
+}
+
+// A half-open range of positions.
+type interval struct {
+	start, end int
+}
+
+// Load reads a mask from a BED file.
+func Load(file string) (*Mask, error) {
+	f, err := aio.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return m, nil
+}
+
+// Read reads a mask from a BED stream. Only the first three columns are
+// used. Header, track and comment lines are skipped.
+func Read(r io.Reader) (*Mask, error) {
+	m := map[string][]interval{}
+	sc := bufio.NewScanner(r)
+	for i := 1; sc.Scan(); i++ {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "track") ||
+			strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: bad number of fields: %d",
+				i, len(fields))
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad start: %w", i, err)
+		}
+		end, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad end: %w", i, err)
+		}
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("line %d: bad range: %d-%d", i, start, end)
+		}
+		if start < end {
+			m[fields[0]] = append(m[fields[0]], interval{start, end})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for name, ivs := range m {
+		m[name] = merge(ivs)
+	}
+	return &Mask{m}, nil
+}
+
+// Sorts the given intervals and merges overlapping ones.
+func merge(ivs []interval) []interval {
+	slices.SortFunc(ivs, func(a, b interval) int {
+		return a.start - b.start
+	})
+	result := ivs[:1]
+	for _, iv := range ivs[1:] {
+		last := &result[len(result)-1]
+		if iv.start <= last.end {
+			last.end = max(last.end, iv.end)
+		} else {
+			result = append(result, iv)
+		}
+	}
+	return result
+}
+
+// Has returns whether the given position is masked.
+func (m *Mask) Has(name string, pos int) bool {
+	ivs := m.m[name]
+	i := sort.Search(len(ivs), func(i int) bool { return ivs[i].end > pos })
+	return i < len(ivs) && ivs[i].start <= pos
+}
+
+// Overlap returns the number of masked positions in the given range.
+func (m *Mask) Overlap(name string, start, end int) int {
+	ivs := m.m[name]
+	i := sort.Search(len(ivs), func(i int) bool { return ivs[i].end > start })
+	n := 0
+	for ; i < len(ivs) && ivs[i].start < end; i++ {
+		n += min(ivs[i].end, end) - max(ivs[i].start, start)
+	}
+	return n
+}
+
+// Checksum returns a checksum of the masked regions.
+func (m *Mask) Checksum() string {
+	h := sha256.New()
+	for _, name := range snm.Sorted(maps.Keys(m.m)) {
+		for _, iv := range m.m[name] {
+			fmt.Fprintf(h, "%s\t%d\t%d\n", name, iv.start, iv.end)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
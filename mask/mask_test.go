@@ -0,0 +1,52 @@
+package mask
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	input := "track name=test\n" +
+		"a\t10\t20\n" +
+		"a\t15\t30\tname\n" +
+		"# comment\n" +
+		"a\t40\t50\n" +
+		"b\t0\t5\n"
+	m, err := Read(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Read(...) failed: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		pos  int
+		want bool
+	}{
+		{"a", 9, false}, {"a", 10, true}, {"a", 29, true}, {"a", 30, false},
+		{"a", 45, true}, {"b", 4, true}, {"b", 5, false}, {"c", 0, false},
+	} {
+		if got := m.Has(test.name, test.pos); got != test.want {
+			t.Errorf("Has(%q,%v)=%v, want %v", test.name, test.pos, got,
+				test.want)
+		}
+	}
+	for _, test := range []struct {
+		name       string
+		start, end int
+		want       int
+	}{
+		{"a", 0, 100, 30}, {"a", 25, 45, 10}, {"a", 30, 40, 0}, {"c", 0, 9, 0},
+	} {
+		if got := m.Overlap(test.name, test.start, test.end); got != test.want {
+			t.Errorf("Overlap(%q,%v,%v)=%v, want %v", test.name, test.start,
+				test.end, got, test.want)
+		}
+	}
+}
+
+func TestRead_bad(t *testing.T) {
+	for _, input := range []string{"a\t10\n", "a\tx\t20\n", "a\t20\t10\n"} {
+		if _, err := Read(strings.NewReader(input)); err == nil {
+			t.Errorf("Read(%q) succeeded, want error", input)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package minimap provides functionality for running minimap2.
+package minimap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/samfile"
+	"github.com/fluhus/bundy/sampipe"
+	"github.com/fluhus/bundy/simreads"
+)
+
+const (
+	exe = "minimap2"
+)
+
+// Minimap runs minimap2 with its short read preset, with a fixed reference
+// and settings.
+//
+// A Minimap keeps the header of its last run, so it is not safe for
+// concurrent runs. Use a separate instance for each concurrent run.
+type Minimap struct {
+	Ref     string   // Minimap2 index or reference fasta.
+	Threads int      // Number of threads.
+	Args    []string // Additional arguments to minimap2.
+
+	header *samfile.Header
+}
+
+// Header returns the SAM header of the last run.
+// Available once iteration has started.
+func (m *Minimap) Header() *samfile.Header {
+	return m.header
+}
+
+// Map runs minimap on the given fastq file.
+func (m *Minimap) Map(ctx context.Context, fq string,
+) iter.Seq2[*sam.SAM, error] {
+	return m.run(ctx, nil, fq)
+}
+
+// Map2 runs minimap on the given paired-end fastq files.
+func (m *Minimap) Map2(ctx context.Context, fq1, fq2 string,
+) iter.Seq2[*sam.SAM, error] {
+	return m.run(ctx, nil, fq1, fq2)
+}
+
+// MapInt runs minimap on the given interleaved pairs fastq file.
+func (m *Minimap) MapInt(ctx context.Context, fq string,
+) iter.Seq2[*sam.SAM, error] {
+	return m.run(ctx, nil, "--frag=yes", fq)
+}
+
+// MapReader runs minimap on the given fastq stream.
+func (m *Minimap) MapReader(ctx context.Context, fq io.Reader,
+) iter.Seq2[*sam.SAM, error] {
+	return m.run(ctx, fq, "-")
+}
+
+// MapIntReader runs minimap on the given interleaved pairs fastq stream.
+func (m *Minimap) MapIntReader(ctx context.Context, fq io.Reader,
+) iter.Seq2[*sam.SAM, error] {
+	return m.run(ctx, fq, "--frag=yes", "-")
+}
+
+// MapKmers runs minimap on the k-mers of the given fasta stream.
+// Since minimap has no k-mer extraction of its own, the reads are generated
+// by this package.
+func (m *Minimap) MapKmers(ctx context.Context, fa io.Reader, k, step int,
+) iter.Seq2[*sam.SAM, error] {
+	return m.MapReader(ctx, simreads.Kmers(fa, k, step))
+}
+
+// Runs minimap with the given input arguments and returns a real-time
+// iterator over the resulting SAM lines. Stdin may be nil.
+// The output may contain supplementary alignments, which callers should skip.
+// The minimap process is killed if ctx is canceled or if iteration stops
+// early.
+func (m *Minimap) run(ctx context.Context, stdin io.Reader, in ...string,
+) iter.Seq2[*sam.SAM, error] {
+	args := []string{"-a", "-x", "sr", "--secondary=no",
+		"-t", fmt.Sprint(m.Threads)}
+	args = append(args, m.Args...)
+	args = append(args, m.Ref)
+	args = append(args, in...)
+	return sampipe.Run(ctx, exe, args, stdin, func(h *samfile.Header) {
+		m.header = h
+	}, nil)
+}
@@ -0,0 +1,624 @@
+// BAM encoding and decoding.
+
+package samfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/gostuff/snm"
+)
+
+const (
+	bamMagic   = "BAM\x01"
+	cigarOps   = "MIDNSHP=X"
+	seqLetters = "=ACMGRSVTWYHKDBN"
+)
+
+// Writes SAM records as BAM.
+type bamWriter struct {
+	w      *bgzfWriter
+	refIDs map[string]int
+	buf    []byte
+}
+
+// NewBAMWriter returns a writer that writes BAM to w, starting with the
+// given header. Records must only refer to reference sequences that are
+// in the header. Closing it closes w.
+func NewBAMWriter(w io.WriteCloser, h *Header) (Writer, error) {
+	if h == nil {
+		h = &Header{}
+	}
+	bw := &bamWriter{w: newBGZFWriter(w), refIDs: map[string]int{}}
+	for i, ref := range h.Refs {
+		bw.refIDs[ref.Name] = i
+	}
+	if _, err := bw.w.Write(encodeBAMHeader(h)); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (w *bamWriter) Write(sm *sam.SAM) error {
+	txt, _ := sm.MarshalText()
+	var err error
+	w.buf, err = w.encodeRecord(w.buf[:0], txt)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(w.buf)
+	return err
+}
+
+func (w *bamWriter) Close() error {
+	return w.w.Close()
+}
+
+// Returns the binary BAM header.
+func encodeBAMHeader(h *Header) []byte {
+	var text string
+	if len(h.Lines) > 0 {
+		text = strings.Join(h.Lines, "\n") + "\n"
+	}
+	b := []byte(bamMagic)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(text)))
+	b = append(b, text...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(h.Refs)))
+	for _, ref := range h.Refs {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(ref.Name)+1))
+		b = append(b, ref.Name...)
+		b = append(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, uint32(ref.Len))
+	}
+	return b
+}
+
+// Appends the BAM encoding of the given SAM line to b.
+// Works on the text form so that optional fields are preserved.
+func (w *bamWriter) encodeRecord(b []byte, txt []byte) ([]byte, error) {
+	fields := strings.Split(strings.TrimRight(string(txt), "\r\n"), "\t")
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("bad SAM line: %q", txt)
+	}
+	atoi := func(i int) (int, error) {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return 0, fmt.Errorf("bad SAM field %d: %q", i+1, fields[i])
+		}
+		return n, nil
+	}
+	flag, err := atoi(1)
+	if err != nil {
+		return nil, err
+	}
+	refID, err := w.refID(fields[2], -1)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := atoi(3)
+	if err != nil {
+		return nil, err
+	}
+	mapq, err := atoi(4)
+	if err != nil {
+		return nil, err
+	}
+	cigar, reflen, err := encodeCigar(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	nextRefID, err := w.refID(fields[6], refID)
+	if err != nil {
+		return nil, err
+	}
+	pnext, err := atoi(7)
+	if err != nil {
+		return nil, err
+	}
+	tlen, err := atoi(8)
+	if err != nil {
+		return nil, err
+	}
+	seq, qual := fields[9], fields[10]
+	if seq == "*" {
+		seq = ""
+	}
+	if qual != "*" && len(qual) != len(seq) {
+		return nil, fmt.Errorf("sequence and quality lengths differ: %v, %v",
+			len(seq), len(qual))
+	}
+	qname := fields[0]
+	if len(qname) > 254 {
+		return nil, fmt.Errorf("read name too long: %v", len(qname))
+	}
+
+	start := len(b)
+	b = binary.LittleEndian.AppendUint32(b, 0) // Block size placeholder.
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(refID)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(pos-1)))
+	b = append(b, byte(len(qname)+1), byte(mapq))
+	b = binary.LittleEndian.AppendUint16(b,
+		uint16(reg2bin(pos-1, pos-1+max(reflen, 1))))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(cigar)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(flag))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(seq)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(nextRefID)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(pnext-1)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(tlen)))
+	b = append(b, qname...)
+	b = append(b, 0)
+	for _, op := range cigar {
+		b = binary.LittleEndian.AppendUint32(b, op)
+	}
+	b = encodeSeq(b, seq)
+	if qual == "*" {
+		for range seq {
+			b = append(b, 0xff)
+		}
+	} else {
+		for _, q := range []byte(qual) {
+			b = append(b, q-33)
+		}
+	}
+	for _, tag := range fields[11:] {
+		if b, err = encodeTag(b, tag); err != nil {
+			return nil, err
+		}
+	}
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b, nil
+}
+
+// Returns the ID of the given reference name. Same is returned for "=".
+func (w *bamWriter) refID(name string, same int) (int, error) {
+	switch name {
+	case "*":
+		return -1, nil
+	case "=":
+		return same, nil
+	}
+	id, ok := w.refIDs[name]
+	if !ok {
+		return 0, fmt.Errorf("reference %q is not in the header", name)
+	}
+	return id, nil
+}
+
+// Returns the binary CIGAR operations and the length they span on the
+// reference.
+func encodeCigar(cigar string) ([]uint32, int, error) {
+	if cigar == "*" {
+		return nil, 0, nil
+	}
+	var ops []uint32
+	reflen, n := 0, 0
+	for _, c := range []byte(cigar) {
+		if c >= '0' && c <= '9' {
+			n = n*10 + int(c-'0')
+			continue
+		}
+		op := strings.IndexByte(cigarOps, c)
+		if op == -1 {
+			return nil, 0, fmt.Errorf("bad CIGAR: %q", cigar)
+		}
+		if strings.IndexByte("MDN=X", c) != -1 {
+			reflen += n
+		}
+		ops = append(ops, uint32(n)<<4|uint32(op))
+		n = 0
+	}
+	return ops, reflen, nil
+}
+
+// Appends the 4-bit encoding of seq to b.
+func encodeSeq(b []byte, seq string) []byte {
+	for i := 0; i < len(seq); i += 2 {
+		x := seqCode(seq[i]) << 4
+		if i+1 < len(seq) {
+			x |= seqCode(seq[i+1])
+		}
+		b = append(b, x)
+	}
+	return b
+}
+
+// Returns the 4-bit code of a nucleotide letter.
+func seqCode(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	i := strings.IndexByte(seqLetters, c)
+	if i == -1 {
+		return 15 // N
+	}
+	return byte(i)
+}
+
+// Appends the binary encoding of a textual optional field (TG:T:VALUE) to b.
+func encodeTag(b []byte, tag string) ([]byte, error) {
+	parts := strings.SplitN(tag, ":", 3)
+	if len(parts) != 3 || len(parts[0]) != 2 || len(parts[1]) != 1 {
+		return nil, fmt.Errorf("bad optional field: %q", tag)
+	}
+	b = append(b, parts[0]...)
+	val := parts[2]
+	switch parts[1][0] {
+	case 'A':
+		if len(val) != 1 {
+			return nil, fmt.Errorf("bad optional field: %q", tag)
+		}
+		b = append(b, 'A', val[0])
+	case 'i':
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad optional field: %q", tag)
+		}
+		if n > math.MaxInt32 {
+			b = append(b, 'I')
+			b = binary.LittleEndian.AppendUint32(b, uint32(n))
+		} else {
+			b = append(b, 'i')
+			b = binary.LittleEndian.AppendUint32(b, uint32(int32(n)))
+		}
+	case 'f':
+		f, err := strconv.ParseFloat(val, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad optional field: %q", tag)
+		}
+		b = append(b, 'f')
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f)))
+	case 'Z', 'H':
+		b = append(b, parts[1][0])
+		b = append(b, val...)
+		b = append(b, 0)
+	case 'B':
+		vals := strings.Split(val, ",")
+		if len(vals[0]) != 1 || bamTypeSize(vals[0][0]) == 0 {
+			return nil, fmt.Errorf("bad optional field: %q", tag)
+		}
+		t := vals[0][0]
+		b = append(b, 'B', t)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(vals)-1))
+		for _, v := range vals[1:] {
+			var err error
+			if b, err = appendNumber(b, t, v); err != nil {
+				return nil, fmt.Errorf("bad optional field: %q", tag)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("bad optional field type: %q", tag)
+	}
+	return b, nil
+}
+
+// Appends a number of the given BAM type to b.
+func appendNumber(b []byte, t byte, v string) ([]byte, error) {
+	if t == 'f' {
+		f, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return nil, err
+		}
+		return binary.LittleEndian.AppendUint32(b,
+			math.Float32bits(float32(f))), nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	switch bamTypeSize(t) {
+	case 1:
+		return append(b, byte(n)), nil
+	case 2:
+		return binary.LittleEndian.AppendUint16(b, uint16(n)), nil
+	default:
+		return binary.LittleEndian.AppendUint32(b, uint32(n)), nil
+	}
+}
+
+// Returns the size in bytes of a numeric BAM type, or 0 if not numeric.
+func bamTypeSize(t byte) int {
+	switch t {
+	case 'c', 'C':
+		return 1
+	case 's', 'S':
+		return 2
+	case 'i', 'I', 'f':
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Returns the BAI bin of the given 0-based, end-exclusive region.
+func reg2bin(beg, end int) int {
+	end--
+	switch {
+	case beg>>14 == end>>14:
+		return ((1<<15)-1)/7 + (beg >> 14)
+	case beg>>17 == end>>17:
+		return ((1<<12)-1)/7 + (beg >> 17)
+	case beg>>20 == end>>20:
+		return ((1<<9)-1)/7 + (beg >> 20)
+	case beg>>23 == end>>23:
+		return ((1<<6)-1)/7 + (beg >> 23)
+	case beg>>26 == end>>26:
+		return ((1<<3)-1)/7 + (beg >> 26)
+	}
+	return 0
+}
+
+// Reads the BAM header from a decompressed BAM stream.
+func readBAMHeader(r io.Reader) (*Header, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != bamMagic {
+		return nil, fmt.Errorf("bad BAM magic: %q", magic)
+	}
+	text, err := readBAMString(r)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHeader(bufio.NewReader(strings.NewReader(text)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The binary reference list is the authoritative one.
+	var nref uint32
+	if err := binary.Read(r, binary.LittleEndian, &nref); err != nil {
+		return nil, err
+	}
+	h.Refs = nil
+	for range nref {
+		name, err := readBAMString(r)
+		if err != nil {
+			return nil, err
+		}
+		var l uint32
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return nil, err
+		}
+		h.Refs = append(h.Refs, Ref{strings.TrimRight(name, "\x00"), int(l)})
+	}
+	return h, nil
+}
+
+// Reads a length-prefixed string.
+func readBAMString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Decodes a decompressed stream of BAM records.
+type bamReader struct {
+	r    io.Reader
+	refs []Ref
+	rec  []byte
+}
+
+// Iterates over the records.
+func (r *bamReader) iter() iter.Seq2[*sam.SAM, error] {
+	return func(yield func(*sam.SAM, error) bool) {
+		for {
+			sm, err := r.next()
+			if err == io.EOF {
+				return
+			}
+			if !yield(sm, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Reads and decodes the next record. Returns io.EOF at the end of the
+// stream.
+func (r *bamReader) next() (*sam.SAM, error) {
+	var n uint32
+	if err := binary.Read(r.r, binary.LittleEndian, &n); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated BAM record")
+		}
+		return nil, err // Including io.EOF at a record boundary.
+	}
+	if n < 32 {
+		return nil, fmt.Errorf("bad BAM record size: %v", n)
+	}
+	if cap(r.rec) < int(n) {
+		r.rec = make([]byte, n)
+	}
+	r.rec = r.rec[:n]
+	if _, err := io.ReadFull(r.r, r.rec); err != nil {
+		return nil, fmt.Errorf("truncated BAM record")
+	}
+	return r.decodeRecord(r.rec)
+}
+
+// Decodes a binary record. Optional fields are decoded to int, float64 or
+// string values, and arrays to []int or []float64.
+func (r *bamReader) decodeRecord(rec []byte) (*sam.SAM, error) {
+	le := binary.LittleEndian
+	refID := int32(le.Uint32(rec[0:]))
+	lname := int(rec[8])
+	ncigar := int(le.Uint16(rec[12:]))
+	lseq := int(le.Uint32(rec[16:]))
+	nextRefID := int32(le.Uint32(rec[20:]))
+	sm := &sam.SAM{
+		Pos:   int(int32(le.Uint32(rec[4:]))) + 1,
+		Mapq:  int(rec[9]),
+		Flag:  int(le.Uint16(rec[14:])),
+		Pnext: int(int32(le.Uint32(rec[24:]))) + 1,
+		Tlen:  int(int32(le.Uint32(rec[28:]))),
+	}
+	rec = rec[32:]
+	if len(rec) < lname+4*ncigar+(lseq+1)/2+lseq {
+		return nil, fmt.Errorf("truncated BAM record")
+	}
+
+	name := rec[:lname]
+	rec = rec[lname:]
+	if len(name) > 0 && name[len(name)-1] == 0 {
+		name = name[:len(name)-1]
+	}
+	sm.Qname = string(name)
+	var err error
+	if sm.Rname, err = r.refName(refID); err != nil {
+		return nil, err
+	}
+	if sm.Rnext, err = r.refName(nextRefID); err != nil {
+		return nil, err
+	}
+	if nextRefID == refID && refID != -1 {
+		sm.Rnext = "="
+	}
+
+	var b strings.Builder
+	if ncigar == 0 {
+		b.WriteByte('*')
+	}
+	for i := range ncigar {
+		op := le.Uint32(rec[4*i:])
+		if int(op&0xf) >= len(cigarOps) {
+			return nil, fmt.Errorf("bad CIGAR operation: %v", op&0xf)
+		}
+		b.WriteString(strconv.Itoa(int(op >> 4)))
+		b.WriteByte(cigarOps[op&0xf])
+	}
+	sm.Cigar = b.String()
+	rec = rec[4*ncigar:]
+
+	seq := make([]byte, max(lseq, 1))
+	seq[0] = '*'
+	for i := range lseq {
+		x := rec[i/2]
+		if i%2 == 0 {
+			x >>= 4
+		}
+		seq[i] = seqLetters[x&0xf]
+	}
+	sm.Seq = string(seq)
+	rec = rec[(lseq+1)/2:]
+	if lseq == 0 || rec[0] == 0xff {
+		sm.Qual = "*"
+	} else {
+		qual := make([]byte, lseq)
+		for i, q := range rec[:lseq] {
+			qual[i] = q + 33
+		}
+		sm.Qual = string(qual)
+	}
+	rec = rec[lseq:]
+	for len(rec) > 0 {
+		if sm.Tags == nil {
+			sm.Tags = map[string]any{}
+		}
+		var tag string
+		var val any
+		if tag, val, rec, err = decodeTag(rec); err != nil {
+			return nil, err
+		}
+		sm.Tags[tag] = val
+	}
+	return sm, nil
+}
+
+// Returns the name of the given reference ID.
+func (r *bamReader) refName(id int32) (string, error) {
+	if id == -1 {
+		return "*", nil
+	}
+	if id < 0 || int(id) >= len(r.refs) {
+		return "", fmt.Errorf("bad reference ID: %v", id)
+	}
+	return r.refs[id].Name, nil
+}
+
+// Decodes the binary optional field at the start of rec. Returns its name,
+// its value and the rest of rec.
+func decodeTag(rec []byte) (string, any, []byte, error) {
+	if len(rec) < 3 {
+		return "", nil, nil, fmt.Errorf("truncated optional field")
+	}
+	tag, t := string(rec[:2]), rec[2]
+	rec = rec[3:]
+	switch t {
+	case 'A':
+		if len(rec) < 1 {
+			return "", nil, nil, fmt.Errorf("truncated optional field")
+		}
+		return tag, string(rec[:1]), rec[1:], nil
+	case 'c', 'C', 's', 'S', 'i', 'I', 'f':
+		if len(rec) < bamTypeSize(t) {
+			return "", nil, nil, fmt.Errorf("truncated optional field")
+		}
+		return tag, readNumber(t, rec), rec[bamTypeSize(t):], nil
+	case 'Z', 'H':
+		i := bytes.IndexByte(rec, 0)
+		if i == -1 {
+			return "", nil, nil, fmt.Errorf("truncated optional field")
+		}
+		return tag, string(rec[:i]), rec[i+1:], nil
+	case 'B':
+		if len(rec) < 5 || bamTypeSize(rec[0]) == 0 {
+			return "", nil, nil, fmt.Errorf("bad array optional field")
+		}
+		at := rec[0]
+		n := int(binary.LittleEndian.Uint32(rec[1:]))
+		rec = rec[5:]
+		size := bamTypeSize(at)
+		if len(rec) < n*size {
+			return "", nil, nil, fmt.Errorf("truncated optional field")
+		}
+		var val any
+		if at == 'f' {
+			val = snm.Slice(n, func(i int) float64 {
+				return readNumber(at, rec[i*size:]).(float64)
+			})
+		} else {
+			val = snm.Slice(n, func(i int) int {
+				return readNumber(at, rec[i*size:]).(int)
+			})
+		}
+		return tag, val, rec[n*size:], nil
+	default:
+		return "", nil, nil, fmt.Errorf("bad optional field type: %q", t)
+	}
+}
+
+// Returns a number of the given BAM type, as an int or a float64.
+func readNumber(t byte, rec []byte) any {
+	le := binary.LittleEndian
+	switch t {
+	case 'c':
+		return int(int8(rec[0]))
+	case 'C':
+		return int(rec[0])
+	case 's':
+		return int(int16(le.Uint16(rec)))
+	case 'S':
+		return int(le.Uint16(rec))
+	case 'i':
+		return int(int32(le.Uint32(rec)))
+	case 'I':
+		return int(le.Uint32(rec))
+	default: // 'f'
+		return float64(math.Float32frombits(le.Uint32(rec)))
+	}
+}
@@ -0,0 +1,98 @@
+// BGZF compression, the blocked gzip format used by BAM.
+
+package samfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Maximal uncompressed size of a single BGZF block. Keeps the compressed
+	// block under 64KB even for incompressible data.
+	bgzfBlockSize = 0xff00
+)
+
+// The empty block that marks the end of a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 0x06, 0, 0x42, 0x43, 0x02, 0,
+	0x1b, 0, 0x03, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+}
+
+// Writes BGZF blocks to an underlying writer.
+// BGZF files are valid multi-member gzip files, so reading is done with
+// compress/gzip.
+type bgzfWriter struct {
+	w    io.WriteCloser
+	buf  []byte        // Uncompressed data of the current block.
+	cbuf *bytes.Buffer // Compressed data of the current block.
+	fw   *flate.Writer
+}
+
+// Returns a new BGZF writer over w. Closing it closes w.
+func newBGZFWriter(w io.WriteCloser) *bgzfWriter {
+	cbuf := &bytes.Buffer{}
+	fw, _ := flate.NewWriter(cbuf, flate.DefaultCompression)
+	return &bgzfWriter{w: w, cbuf: cbuf, fw: fw,
+		buf: make([]byte, 0, bgzfBlockSize)}
+}
+
+func (w *bgzfWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := min(len(p), bgzfBlockSize-len(w.buf))
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(w.buf) == bgzfBlockSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Writes the current block, if not empty.
+func (w *bgzfWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.cbuf.Reset()
+	w.fw.Reset(w.cbuf)
+	if _, err := w.fw.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.fw.Close(); err != nil {
+		return err
+	}
+
+	// Header, with the BC extra field holding the total block size - 1.
+	block := make([]byte, 0, w.cbuf.Len()+26)
+	block = append(block, 0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff,
+		0x06, 0, 'B', 'C', 0x02, 0)
+	block = binary.LittleEndian.AppendUint16(block,
+		uint16(w.cbuf.Len()+25))
+	block = append(block, w.cbuf.Bytes()...)
+	block = binary.LittleEndian.AppendUint32(block,
+		crc32.ChecksumIEEE(w.buf))
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(w.buf)))
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(block)
+	return err
+}
+
+// Writes the remaining data and the EOF marker, and closes the underlying
+// writer.
+func (w *bgzfWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(bgzfEOF); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,204 @@
+// Package samfile reads and writes SAM and BAM files along with their headers.
+package samfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/gostuff/aio"
+)
+
+// Header holds the header of a SAM file.
+type Header struct {
+	Lines []string // Raw header lines, without line breaks.
+	Refs  []Ref    // Reference sequences from @SQ lines, in order.
+}
+
+// Ref is a reference sequence from a @SQ header line.
+type Ref struct {
+	Name string // SN field.
+	Len  int    // LN field.
+}
+
+// A Reader reads a SAM or BAM header and then the records that follow it.
+type Reader struct {
+	Header *Header
+	r      io.Reader
+	bam    *bamReader // Nil for SAM input.
+	c      io.Closer
+}
+
+// NewReader reads the header from r and returns a reader positioned
+// at the first record. The input may be SAM, gzipped SAM or BAM.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(zr)
+		if magic, _ := br.Peek(4); string(magic) == bamMagic {
+			h, err := readBAMHeader(br)
+			if err != nil {
+				return nil, err
+			}
+			return &Reader{Header: h,
+				bam: &bamReader{r: br, refs: h.Refs}}, nil
+		}
+	}
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Header: h, r: br}, nil
+}
+
+// Open opens a SAM or BAM file for reading. "-" reads from stdin.
+// Compressed SAM files are supported according to their extension.
+func Open(file string) (*Reader, error) {
+	var f io.ReadCloser = os.Stdin
+	if file != "-" {
+		var err error
+		f, err = aio.Open(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.c = f
+	return r, nil
+}
+
+// Iter returns an iterator over the records.
+// Can be iterated over only once.
+func (r *Reader) Iter() iter.Seq2[*sam.SAM, error] {
+	if r.bam != nil {
+		return r.bam.iter()
+	}
+	return sam.Reader(r.r)
+}
+
+// Close closes the underlying file, if opened with Open.
+func (r *Reader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	return r.c.Close()
+}
+
+// A Writer writes SAM records.
+type Writer interface {
+	Write(sm *sam.SAM) error
+	Close() error
+}
+
+// Writes SAM text.
+type samWriter struct {
+	w io.WriteCloser
+}
+
+// NewWriter returns a writer that writes SAM text to w, starting with the
+// given header. A nil header writes no header. Closing it closes w.
+func NewWriter(w io.WriteCloser, h *Header) (Writer, error) {
+	if h != nil {
+		for _, line := range h.Lines {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &samWriter{w}, nil
+}
+
+func (w *samWriter) Write(sm *sam.SAM) error {
+	txt, _ := sm.MarshalText()
+	_, err := w.w.Write(txt)
+	return err
+}
+
+func (w *samWriter) Close() error {
+	return w.w.Close()
+}
+
+// Create creates a file and returns a writer to it.
+// Files with a .bam extension are written as BAM, and other files as SAM
+// text, compressed according to their extension.
+func Create(file string, h *Header) (Writer, error) {
+	if filepath.Ext(file) == ".bam" {
+		f, err := aio.CreateRaw(file)
+		if err != nil {
+			return nil, err
+		}
+		return NewBAMWriter(f, h)
+	}
+	f, err := aio.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(f, h)
+}
+
+// Reads header lines until the first non-header line.
+func readHeader(r *bufio.Reader) (*Header, error) {
+	h := &Header{}
+	for {
+		b, err := r.Peek(1)
+		if err == io.EOF {
+			return h, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '@' {
+			return h, nil
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		h.Lines = append(h.Lines, line)
+		if strings.HasPrefix(line, "@SQ\t") {
+			ref, err := parseSQ(line)
+			if err != nil {
+				return nil, err
+			}
+			h.Refs = append(h.Refs, ref)
+		}
+	}
+}
+
+// Parses a @SQ header line.
+func parseSQ(line string) (Ref, error) {
+	var ref Ref
+	for _, field := range strings.Split(line, "\t")[1:] {
+		switch {
+		case strings.HasPrefix(field, "SN:"):
+			ref.Name = field[3:]
+		case strings.HasPrefix(field, "LN:"):
+			n, err := strconv.Atoi(field[3:])
+			if err != nil {
+				return Ref{}, fmt.Errorf("bad @SQ length: %q", field)
+			}
+			ref.Len = n
+		}
+	}
+	if ref.Name == "" {
+		return Ref{}, fmt.Errorf("@SQ line has no name: %q", line)
+	}
+	return ref, nil
+}
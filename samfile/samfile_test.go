@@ -0,0 +1,147 @@
+package samfile
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fluhus/biostuff/formats/sam"
+)
+
+func TestReader(t *testing.T) {
+	input := "@HD\tVN:1.6\n" +
+		"@SQ\tSN:chr1\tLN:1000\n" +
+		"@SQ\tSN:chr2\tLN:500\n" +
+		"r1\t0\tchr1\t5\t42\t4M\t*\t0\t0\tACGT\tIIII\n"
+	r, err := NewReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("NewReader(...) failed: %v", err)
+	}
+	wantRefs := []Ref{{"chr1", 1000}, {"chr2", 500}}
+	if !reflect.DeepEqual(r.Header.Refs, wantRefs) {
+		t.Fatalf("Refs=%v, want %v", r.Header.Refs, wantRefs)
+	}
+	if len(r.Header.Lines) != 3 {
+		t.Fatalf("len(Lines)=%v, want 3", len(r.Header.Lines))
+	}
+	n := 0
+	for sm, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter() failed: %v", err)
+		}
+		if sm.Qname != "r1" || sm.Rname != "chr1" || sm.Pos != 5 {
+			t.Fatalf("Iter()=%v, want r1 on chr1:5", sm)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("Iter() returned %v records, want 1", n)
+	}
+}
+
+func TestBAMRoundTrip(t *testing.T) {
+	input := "@HD\tVN:1.6\n" +
+		"@SQ\tSN:chr1\tLN:1000\n" +
+		"@SQ\tSN:chr2\tLN:500\n" +
+		"r1\t99\tchr1\t5\t42\t2S3M1I2M\t=\t20\t23\tACGTACGT\tIIIIHHHH\tAS:i:-3\tYT:Z:CP\n" +
+		"r2\t4\t*\t0\t0\t*\t*\t0\t0\tNNA\t*\n"
+	r, err := NewReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("NewReader(...) failed: %v", err)
+	}
+	buf := &bytesBufferCloser{}
+	w, err := NewBAMWriter(buf, r.Header)
+	if err != nil {
+		t.Fatalf("NewBAMWriter(...) failed: %v", err)
+	}
+	var want []string
+	for sm, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter() failed: %v", err)
+		}
+		txt, _ := sm.MarshalText()
+		want = append(want, string(txt))
+		if err := w.Write(sm); err != nil {
+			t.Fatalf("Write(%v) failed: %v", sm, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r, err = NewReader(&buf.Buffer)
+	if err != nil {
+		t.Fatalf("NewReader(BAM) failed: %v", err)
+	}
+	if !reflect.DeepEqual(r.Header.Refs, []Ref{{"chr1", 1000}, {"chr2", 500}}) {
+		t.Fatalf("Refs=%v, want chr1 and chr2", r.Header.Refs)
+	}
+	var got []string
+	for sm, err := range r.Iter() {
+		if err != nil {
+			t.Fatalf("Iter(BAM) failed: %v", err)
+		}
+		txt, _ := sm.MarshalText()
+		got = append(got, string(txt))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Iter(BAM)=%q, want %q", got, want)
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	line := "r1\t99\tchr1\t5\t42\t2S3M1I2M\t=\t20\t23\tACGTACGT\tIIIIHHHH" +
+		"\tAS:i:-3\tYT:Z:CP"
+	refs := []Ref{{"chr1", 1000}}
+	w := &bamWriter{refIDs: map[string]int{"chr1": 0}}
+	b, err := w.encodeRecord(nil, []byte(line))
+	if err != nil {
+		t.Fatalf("encodeRecord(%q) failed: %v", line, err)
+	}
+	r := &bamReader{refs: refs}
+	got, err := r.decodeRecord(b[4:])
+	if err != nil {
+		t.Fatalf("decodeRecord(...) failed: %v", err)
+	}
+	want := &sam.SAM{Qname: "r1", Flag: 99, Rname: "chr1", Pos: 5, Mapq: 42,
+		Cigar: "2S3M1I2M", Rnext: "=", Pnext: 20, Tlen: 23, Seq: "ACGTACGT",
+		Qual: "IIIIHHHH", Tags: map[string]any{"AS": -3, "YT": "CP"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodeRecord(...)=%+v, want %+v", got, want)
+	}
+}
+
+type bytesBufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bytesBufferCloser) Close() error {
+	return nil
+}
+
+func TestTagRoundTrip(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want any
+	}{
+		{"AS:i:-3", -3}, {"XN:i:3000000000", 3000000000}, {"YT:Z:UU", "UU"},
+		{"XA:A:x", "x"}, {"ZF:f:1.5", 1.5}, {"ZB:B:c,-1,2,3", []int{-1, 2, 3}},
+		{"ZG:B:f,0.5,2", []float64{0.5, 2}}, {"ZH:H:1AE3", "1AE3"},
+	}
+	for _, test := range tests {
+		b, err := encodeTag(nil, test.tag)
+		if err != nil {
+			t.Fatalf("encodeTag(%q) failed: %v", test.tag, err)
+		}
+		name, got, rest, err := decodeTag(b)
+		if err != nil {
+			t.Fatalf("decodeTag(%q) failed: %v", test.tag, err)
+		}
+		if len(rest) != 0 || name != test.tag[:2] ||
+			!reflect.DeepEqual(got, test.want) {
+			t.Fatalf("decodeTag(encodeTag(%q))=%q,%v,%v, want %q,%v,[]",
+				test.tag, name, got, rest, test.tag[:2], test.want)
+		}
+	}
+}
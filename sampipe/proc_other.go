@@ -0,0 +1,8 @@
+//go:build !unix
+
+package sampipe
+
+import "os/exec"
+
+// Keeps the default cancellation, which kills only the process itself.
+func setKillGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package sampipe
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Makes the command run in its own process group and kills the whole group
+// on cancellation, so that children of wrapper scripts (like bowtie2's)
+// are killed too.
+func setKillGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,104 @@
+// Package sampipe runs external programs that write SAM to their standard
+// output, and streams the alignments.
+package sampipe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"os/exec"
+	"time"
+
+	"github.com/fluhus/biostuff/formats/sam"
+	"github.com/fluhus/bundy/samfile"
+)
+
+const (
+	// How long to wait for I/O to finish after the process is killed.
+	waitDelay = 5 * time.Second
+)
+
+// Run runs the given program and returns a real-time iterator over the SAM
+// lines it writes. Stdin may be nil. If onHeader is non-nil, it is called
+// with the SAM header before the first line is yielded. If onStderr is
+// non-nil, it is called with everything the program wrote to stderr, once
+// it exits successfully.
+//
+// The process is killed and reaped if ctx is canceled or if iteration stops
+// early. In that case, if stdin implements io.Closer, it is closed so that
+// whoever feeds it is released.
+func Run(ctx context.Context, name string, args []string, stdin io.Reader,
+	onHeader func(*samfile.Header), onStderr func([]byte),
+) iter.Seq2[*sam.SAM, error] {
+	return func(yield func(*sam.SAM, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		cmd := Command(ctx, name, args...)
+		stderr := bytes.NewBuffer(nil)
+		cmd.Stderr = stderr
+		cmd.Stdin = stdin
+		r, err := cmd.StdoutPipe()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		finished := false
+		defer func() {
+			if finished {
+				return
+			}
+			cancel()
+			if c, ok := stdin.(io.Closer); ok {
+				c.Close()
+			}
+			cmd.Wait()
+		}()
+
+		sr, err := samfile.NewReader(r)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if onHeader != nil {
+			onHeader(sr.Header)
+		}
+		for sm, err := range sr.Iter() {
+			if !yield(sm, err) {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		finished = true
+		if err := cmd.Wait(); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			} else {
+				err = fmt.Errorf("%s: %w\n%s", name, err, stderr.Bytes())
+			}
+			yield(nil, err)
+			return
+		}
+		if onStderr != nil {
+			onStderr(stderr.Bytes())
+		}
+	}
+}
+
+// Command returns a command that runs the given program and is killed,
+// along with its children, when ctx is canceled.
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = waitDelay
+	setKillGroup(cmd)
+	return cmd
+}
@@ -0,0 +1,64 @@
+package sampipe
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/fluhus/bundy/samfile"
+)
+
+func TestRun(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	script := "printf '@SQ\\tSN:c\\tLN:9\\nr1\\t0\\tc\\t1\\t9\\t*\\t*\\t0\\t0\\tA\\tI\\n'"
+	var hlen int
+	n := 0
+	for _, err := range Run(context.Background(), "sh", []string{"-c", script},
+		nil, func(h *samfile.Header) { hlen = len(h.Refs) }, nil) {
+		if err != nil {
+			t.Fatalf("Run(...) failed: %v", err)
+		}
+		n++
+	}
+	if n != 1 || hlen != 1 {
+		t.Fatalf("Run(...) got %v lines and %v refs, want 1 and 1", n, hlen)
+	}
+}
+
+func TestRunEarlyBreak(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	script := "while true; do printf 'r\\t4\\t*\\t0\\t0\\t*\\t*\\t0\\t0\\tA\\tI\\n'; done"
+	done := make(chan struct{})
+	go func() {
+		for range Run(context.Background(), "sh", []string{"-c", script},
+			nil, nil, nil) {
+			break
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run(...) did not return after early break")
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var lastErr error
+	for _, err := range Run(ctx, "sh", []string{"-c", "sleep 30"}, nil, nil, nil) {
+		lastErr = err
+	}
+	if lastErr != context.Canceled {
+		t.Fatalf("Run(...) error=%v, want %v", lastErr, context.Canceled)
+	}
+}
@@ -0,0 +1,118 @@
+package simreads
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+)
+
+// ErrorModel describes the sequencing errors added to simulated reads.
+type ErrorModel struct {
+	// Substitution probability of each base. Ignored if Quals is given.
+	SubRate float64
+
+	// Phred quality of each read position. Position i gets substitutions
+	// with probability 10^(-Quals[i]/10). Positions beyond the profile use
+	// its last value.
+	Quals []int
+
+	// Seed of the random generator, for reproducibility.
+	Seed uint64
+}
+
+// Validate returns an error if the model is invalid.
+func (m *ErrorModel) Validate() error {
+	if m.SubRate < 0 || m.SubRate > 1 {
+		return fmt.Errorf("bad substitution rate: %v", m.SubRate)
+	}
+	for _, q := range m.Quals {
+		if q < 0 || q > maxQual {
+			return fmt.Errorf("bad quality: %v", q)
+		}
+	}
+	return nil
+}
+
+// String returns a short description of the model.
+func (m *ErrorModel) String() string {
+	if len(m.Quals) > 0 {
+		return fmt.Sprintf("quals=%v seed=%v", m.Quals, m.Seed)
+	}
+	return fmt.Sprintf("sub=%v seed=%v", m.SubRate, m.Seed)
+}
+
+// Highest phred quality that has a fastq character.
+const maxQual = 93
+
+// Adds errors to reads of a fixed length.
+type noiser struct {
+	probs []float64 // Error probability per position.
+	quals []byte    // Fastq qualities per position.
+	rnd   *rand.Rand
+}
+
+// Returns a noiser for reads of up to k bases.
+func newNoiser(m *ErrorModel, k int) *noiser {
+	n := &noiser{
+		probs: make([]float64, k),
+		quals: make([]byte, k),
+		rnd:   rand.New(rand.NewPCG(m.Seed, m.Seed)),
+	}
+	for i := range k {
+		if len(m.Quals) > 0 {
+			q := m.Quals[min(i, len(m.Quals)-1)]
+			n.probs[i] = math.Pow(10, -float64(q)/10)
+			n.quals[i] = byte(q + 33)
+		} else {
+			n.probs[i] = m.SubRate
+			n.quals[i] = byte(probToQual(m.SubRate) + 33)
+		}
+	}
+	return n
+}
+
+// Returns a copy of seq with random substitutions.
+func (n *noiser) add(seq []byte) []byte {
+	result := make([]byte, len(seq))
+	for i, b := range seq {
+		result[i] = b
+		if n.rnd.Float64() >= n.probs[i] {
+			continue
+		}
+		if baseIndex(b) == -1 {
+			continue
+		}
+		result[i] = substitute(b, n.rnd.IntN(3))
+	}
+	return result
+}
+
+// Returns the phred quality of the given error probability.
+func probToQual(p float64) int {
+	if p <= 0 {
+		return maxQual
+	}
+	return min(maxQual, int(math.Round(-10*math.Log10(p))))
+}
+
+// Returns the index of a base in "ACGT", ignoring case, or -1.
+func baseIndex(b byte) int {
+	switch b {
+	case 'A', 'a':
+		return 0
+	case 'C', 'c':
+		return 1
+	case 'G', 'g':
+		return 2
+	case 'T', 't':
+		return 3
+	default:
+		return -1
+	}
+}
+
+// Returns the i'th base (0-2) that is different from b.
+func substitute(b byte, i int) byte {
+	j := baseIndex(b)
+	return "ACGT"[(j+1+i)%4]
+}
@@ -0,0 +1,122 @@
+package simreads
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/biostuff/formats/fastq"
+)
+
+// InsertSize describes the fragment length distribution of simulated
+// read pairs, as a normal distribution.
+type InsertSize struct {
+	Mean float64 // Mean fragment length.
+	SD   float64 // Standard deviation of the fragment length.
+	Seed uint64  // Seed of the random generator, for reproducibility.
+}
+
+// Validate returns an error if the distribution is invalid.
+func (s *InsertSize) Validate() error {
+	if s.Mean <= 0 || s.SD < 0 {
+		return fmt.Errorf("bad insert size: mean=%v sd=%v", s.Mean, s.SD)
+	}
+	return nil
+}
+
+// String returns a short description of the distribution.
+func (s *InsertSize) String() string {
+	return fmt.Sprintf("mean=%v sd=%v seed=%v", s.Mean, s.SD, s.Seed)
+}
+
+// Pairs returns an interleaved fastq stream of read pairs of length k from
+// the sequences in the given fasta stream, with a fragment starting every
+// step positions. Fragment lengths are drawn from ins, and are at least k
+// and at most what is left of the sequence. The second mate is reverse
+// complemented. Both mates are named "sequence-name_offset" with the
+// fragment's 0-based offset. Errors are added according to m, if not nil.
+func Pairs(fa io.Reader, k, step int, ins *InsertSize, m *ErrorModel,
+) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writePairs(fa, w, k, step, ins, m))
+	}()
+	return r
+}
+
+// Writes read pairs of the sequences in fa as interleaved fastq to w.
+func writePairs(fa io.Reader, w io.Writer, k, step int, ins *InsertSize,
+	m *ErrorModel) error {
+	if k < 1 || step < 1 {
+		return fmt.Errorf("bad read length or step: %v,%v", k, step)
+	}
+	if err := ins.Validate(); err != nil {
+		return err
+	}
+	var noise *noiser
+	if m != nil {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+		noise = newNoiser(m, k)
+	}
+	rnd := rand.New(rand.NewPCG(ins.Seed, ins.Seed))
+	for fa, err := range fasta.Reader(fa) {
+		if err != nil {
+			return err
+		}
+		name := seqName(fa.Name)
+		seq := fa.Sequence
+		last := max(len(seq)-k, 0)
+		quals := bytes.Repeat([]byte{'I'}, min(k, len(seq)))
+		if noise != nil {
+			quals = noise.quals[:min(k, len(seq))]
+		}
+		for i := 0; i <= last; i += step {
+			frag := int(math.Round(ins.Mean + rnd.NormFloat64()*ins.SD))
+			frag = max(min(frag, len(seq)-i), min(k, len(seq)))
+			mate1 := seq[i:min(i+k, len(seq))]
+			mate2 := revComp(seq[max(i+frag-k, i) : i+frag])
+			if noise != nil {
+				mate1 = noise.add(mate1)
+				mate2 = noise.add(mate2)
+			}
+			for _, mate := range [][]byte{mate1, mate2} {
+				fq := fastq.Fastq{
+					Name:     fmt.Appendf(nil, "%s_%d", name, i),
+					Sequence: mate,
+					Quals:    quals,
+				}
+				txt, _ := fq.MarshalText()
+				if _, err := w.Write(txt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the reverse complement of seq.
+func revComp(seq []byte) []byte {
+	result := make([]byte, len(seq))
+	for i, b := range seq {
+		j := len(seq) - 1 - i
+		switch b {
+		case 'A', 'a':
+			result[j] = 'T'
+		case 'C', 'c':
+			result[j] = 'G'
+		case 'G', 'g':
+			result[j] = 'C'
+		case 'T', 't':
+			result[j] = 'A'
+		default:
+			result[j] = 'N'
+		}
+	}
+	return result
+}
@@ -0,0 +1,80 @@
+// Package simreads generates simulated reads from reference sequences.
+package simreads
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/biostuff/formats/fastq"
+)
+
+// Kmers returns a fastq stream of all the k-mers of the sequences in the given
+// fasta stream, taken every step positions. Sequences shorter than k are
+// emitted whole. Read names are "sequence-name_offset" with a 0-based offset,
+// like bowtie2's -F option.
+func Kmers(fa io.Reader, k, step int) io.Reader {
+	return NoisyKmers(fa, k, step, nil)
+}
+
+// NoisyKmers is like Kmers, but adds substitution errors to the reads
+// according to the given model. A nil model adds no errors.
+func NoisyKmers(fa io.Reader, k, step int, m *ErrorModel) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeKmers(fa, w, k, step, m))
+	}()
+	return r
+}
+
+// Writes the k-mers of the sequences in fa as fastq to w.
+func writeKmers(fa io.Reader, w io.Writer, k, step int, m *ErrorModel,
+) error {
+	if k < 1 || step < 1 {
+		return fmt.Errorf("bad k-mer length or step: %v,%v", k, step)
+	}
+	var noise *noiser
+	if m != nil {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+		noise = newNoiser(m, k)
+	}
+	for fa, err := range fasta.Reader(fa) {
+		if err != nil {
+			return err
+		}
+		name := seqName(fa.Name)
+		seq := fa.Sequence
+		last := max(len(seq)-k, 0)
+		quals := bytes.Repeat([]byte{'I'}, min(k, len(seq)))
+		if noise != nil {
+			quals = noise.quals[:min(k, len(seq))]
+		}
+		for i := 0; i <= last; i += step {
+			fq := fastq.Fastq{
+				Name:     fmt.Appendf(nil, "%s_%d", name, i),
+				Sequence: seq[i:min(i+k, len(seq))],
+				Quals:    quals,
+			}
+			if noise != nil {
+				fq.Sequence = noise.add(fq.Sequence)
+			}
+			txt, _ := fq.MarshalText()
+			if _, err := w.Write(txt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the sequence name up to the first whitespace, the way aligners
+// report reference names.
+func seqName(name []byte) []byte {
+	if i := bytes.IndexAny(name, " \t"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
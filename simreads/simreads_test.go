@@ -0,0 +1,69 @@
+package simreads
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKmers(t *testing.T) {
+	input := ">seq1 some description\nACGTACG\n>seq2\nAC\n"
+	want := "@seq1_0\nACGTA\n+\nIIIII\n" +
+		"@seq1_2\nGTACG\n+\nIIIII\n" +
+		"@seq2_0\nAC\n+\nII\n"
+	got, err := io.ReadAll(Kmers(strings.NewReader(input), 5, 2))
+	if err != nil {
+		t.Fatalf("Kmers(...) failed: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("Kmers(...)=%q, want %q", got, want)
+	}
+}
+
+func TestNoisyKmers(t *testing.T) {
+	input := ">seq1\nACGTACGTAC\n"
+	read := func(m *ErrorModel) string {
+		got, err := io.ReadAll(NoisyKmers(strings.NewReader(input), 10, 1, m))
+		if err != nil {
+			t.Fatalf("NoisyKmers(...) failed: %v", err)
+		}
+		return string(got)
+	}
+
+	if got, want := read(&ErrorModel{}),
+		"@seq1_0\nACGTACGTAC\n+\n~~~~~~~~~~\n"; got != want {
+		t.Errorf("NoisyKmers(rate=0)=%q, want %q", got, want)
+	}
+	got := read(&ErrorModel{SubRate: 1, Seed: 1})
+	seq := strings.Split(got, "\n")[1]
+	for i := range seq {
+		if seq[i] == input[6+i] {
+			t.Errorf("NoisyKmers(rate=1)=%q, base %d not substituted", seq, i)
+		}
+	}
+	if got2 := read(&ErrorModel{SubRate: 1, Seed: 1}); got2 != got {
+		t.Errorf("NoisyKmers(seed=1)=%q, then %q", got, got2)
+	}
+	got = read(&ErrorModel{Quals: []int{40, 30, 0}})
+	if want := "I?!!!!!!!!"; strings.Split(got, "\n")[3] != want {
+		t.Errorf("NoisyKmers(quals)=%q, want quals %q", got, want)
+	}
+}
+
+func TestPairs(t *testing.T) {
+	input := ">seq1\nAACCGGTTAC\n>seq2\nAC\n"
+	want := "@seq1_0\nAACC\n+\nIIII\n" +
+		"@seq1_0\nGTAA\n+\nIIII\n" +
+		"@seq1_6\nTTAC\n+\nIIII\n" +
+		"@seq1_6\nGTAA\n+\nIIII\n" +
+		"@seq2_0\nAC\n+\nII\n" +
+		"@seq2_0\nGT\n+\nII\n"
+	got, err := io.ReadAll(Pairs(strings.NewReader(input), 4, 6,
+		&InsertSize{Mean: 10}, nil))
+	if err != nil {
+		t.Fatalf("Pairs(...) failed: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("Pairs(...)=%q, want %q", got, want)
+	}
+}
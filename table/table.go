@@ -0,0 +1,276 @@
+// Package table reads and writes bundy's per-sample abundance tables and
+// multi-sample matrices.
+package table
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fluhus/bundy/abundance"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/jio"
+	"github.com/fluhus/gostuff/snm"
+	"golang.org/x/exp/maps"
+)
+
+// Columns of the TSV output.
+var (
+	header = []string{"genome", "abundance", "reads", "est_reads",
+		"mean_depth", "median_depth", "copies"}
+	bootHeader = []string{"std_err", "ci_low", "ci_high"}
+)
+
+// Write writes the genomes to a TSV file with a header line, by descending
+// abundance, or to a JSON file of an object per genome. Bootstrap columns
+// are added to the TSV if boot is true.
+func Write(file string, genomes map[string]*abundance.GenomeStats,
+	asJSON, boot bool) error {
+	if asJSON {
+		return jio.Write(file, genomes)
+	}
+	f, err := aio.Create(file)
+	if err != nil {
+		return err
+	}
+	cols := header
+	if boot {
+		cols = slices.Concat(header, bootHeader)
+	}
+	fmt.Fprintln(f, strings.Join(cols, "\t"))
+	for _, k := range Sorted(genomes) {
+		g := genomes[k]
+		fmt.Fprintf(f, "%s\t%g\t%d\t%.1f\t%.3g\t%.3g\t%.3g", k,
+			g.Abundance, g.Reads, g.EstReads, g.MeanDepth, g.MedianDepth,
+			g.Copies)
+		if boot {
+			fmt.Fprintf(f, "\t%g\t%g\t%g", g.StdErr, g.CILow, g.CIHigh)
+		}
+		fmt.Fprintln(f)
+	}
+	return f.Close()
+}
+
+// Sorted returns the genome names by descending abundance, then by name.
+func Sorted(genomes map[string]*abundance.GenomeStats) []string {
+	return snm.SortedFunc(maps.Keys(genomes), func(a, b string) int {
+		return cmp.Or(cmp.Compare(genomes[b].Abundance, genomes[a].Abundance),
+			cmp.Compare(a, b))
+	})
+}
+
+// Read reads a table written by Write, in either format. Also reads tables
+// of older versions, which have only the abundance of each genome: TSV with
+// no header, or JSON with a number per genome.
+func Read(file string) (map[string]*abundance.GenomeStats, error) {
+	f, err := aio.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if b, _ := f.Peek(1); len(b) == 1 && b[0] == '{' {
+		m, err := readJSON(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return m, nil
+	}
+	m, err := readTSV(&f.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return m, nil
+}
+
+// Reads a JSON table, with an object or a number per genome.
+func readJSON(r io.Reader) (map[string]*abundance.GenomeStats, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	m := map[string]*abundance.GenomeStats{}
+	for k, v := range raw {
+		g := &abundance.GenomeStats{}
+		if len(v) > 0 && v[0] == '{' {
+			if err := json.Unmarshal(v, g); err != nil {
+				return nil, fmt.Errorf("genome %q: %w", k, err)
+			}
+		} else if err := json.Unmarshal(v, &g.Abundance); err != nil {
+			return nil, fmt.Errorf("genome %q: %w", k, err)
+		}
+		m[k] = g
+	}
+	return m, nil
+}
+
+// Reads a TSV table.
+func readTSV(r *bufio.Reader) (map[string]*abundance.GenomeStats, error) {
+	m := map[string]*abundance.GenomeStats{}
+	cols := header[:2] // Legacy format.
+	sc := bufio.NewScanner(r)
+	for i := 1; sc.Scan(); i++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if i == 1 && fields[0] == header[0] {
+			cols = fields
+			continue
+		}
+		if len(fields) != len(cols) {
+			return nil, fmt.Errorf("line %d: got %d fields, want %d",
+				i, len(fields), len(cols))
+		}
+		g := &abundance.GenomeStats{}
+		for j, col := range cols[1:] {
+			if err := setField(g, col, fields[j+1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i, err)
+			}
+		}
+		m[fields[0]] = g
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Sets the field of g that matches the given column name.
+// Unknown columns are ignored.
+func setField(g *abundance.GenomeStats, col, value string) error {
+	if col == "reads" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("bad %s: %w", col, err)
+		}
+		g.Reads = n
+		return nil
+	}
+	ptr := floatFields(g)[col]
+	if ptr == nil {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("bad %s: %w", col, err)
+	}
+	*ptr = f
+	return nil
+}
+
+// Returns the float fields of g by column name.
+func floatFields(g *abundance.GenomeStats) map[string]*float64 {
+	return map[string]*float64{
+		"abundance":    &g.Abundance,
+		"est_reads":    &g.EstReads,
+		"mean_depth":   &g.MeanDepth,
+		"median_depth": &g.MedianDepth,
+		"copies":       &g.Copies,
+		"std_err":      &g.StdErr,
+		"ci_low":       &g.CILow,
+		"ci_high":      &g.CIHigh,
+	}
+}
+
+// Field returns a function that returns the value of the given column
+// of a genome.
+func Field(col string) (func(*abundance.GenomeStats) float64, error) {
+	if col == "reads" {
+		return func(g *abundance.GenomeStats) float64 {
+			return float64(g.Reads)
+		}, nil
+	}
+	if floatFields(&abundance.GenomeStats{})[col] == nil {
+		return nil, fmt.Errorf("unknown column: %q", col)
+	}
+	return func(g *abundance.GenomeStats) float64 {
+		return *floatFields(g)[col]
+	}, nil
+}
+
+// Matrix holds a single value of genomes across samples.
+type Matrix struct {
+	Samples []string
+	Genomes []string
+	Values  [][]float64 // Values[i][j] is of genome i in sample j, NaN if missing.
+}
+
+// NewMatrix returns a matrix of the given value, with a row per genome
+// that appears in any of the tables, ordered by name, and a column per
+// sample. tables are ordered like samples.
+func NewMatrix(samples []string, tables []map[string]*abundance.GenomeStats,
+	value func(*abundance.GenomeStats) float64) *Matrix {
+	rows := map[string]struct{}{}
+	for _, t := range tables {
+		for k := range t {
+			rows[k] = struct{}{}
+		}
+	}
+	m := &Matrix{Samples: samples, Genomes: snm.Sorted(maps.Keys(rows))}
+	for _, k := range m.Genomes {
+		m.Values = append(m.Values, snm.Slice(len(tables), func(j int) float64 {
+			if g := tables[j][k]; g != nil {
+				return value(g)
+			}
+			return math.NaN()
+		}))
+	}
+	return m
+}
+
+// Filter keeps only the genomes for which keep returns true. keep gets the
+// genome's name and values across samples.
+func (m *Matrix) Filter(keep func(genome string, values []float64) bool) {
+	var genomes []string
+	var values [][]float64
+	for i, v := range m.Values {
+		if keep(m.Genomes[i], v) {
+			genomes = append(genomes, m.Genomes[i])
+			values = append(values, v)
+		}
+	}
+	m.Genomes, m.Values = genomes, values
+}
+
+// WriteWide writes the matrix as TSV with a row per genome and a column
+// per sample. Missing values are written as fill.
+func (m *Matrix) WriteWide(file, fill string) error {
+	f, err := aio.Create(file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "%s\t%s\n", header[0], strings.Join(m.Samples, "\t"))
+	for i, k := range m.Genomes {
+		fmt.Fprint(f, k)
+		for _, v := range m.Values[i] {
+			if math.IsNaN(v) {
+				fmt.Fprintf(f, "\t%s", fill)
+			} else {
+				fmt.Fprintf(f, "\t%g", v)
+			}
+		}
+		fmt.Fprintln(f)
+	}
+	return f.Close()
+}
+
+// WriteLong writes the matrix as TSV with a row per sample and genome,
+// with the given name for the value column. Missing values are skipped.
+func (m *Matrix) WriteLong(file, col string) error {
+	f, err := aio.Create(file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "sample\t%s\t%s\n", header[0], col)
+	for j, s := range m.Samples {
+		for i, k := range m.Genomes {
+			if v := m.Values[i][j]; !math.IsNaN(v) {
+				fmt.Fprintf(f, "%s\t%s\t%g\n", s, k, v)
+			}
+		}
+	}
+	return f.Close()
+}
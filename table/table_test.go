@@ -0,0 +1,109 @@
+package table
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fluhus/bundy/abundance"
+)
+
+func TestWriteRead(t *testing.T) {
+	genomes := map[string]*abundance.GenomeStats{
+		"a": {Abundance: 0.75, Reads: 300, EstReads: 290.5, MeanDepth: 2,
+			MedianDepth: 1.5, Copies: 2.5, StdErr: 0.01, CILow: 0.7,
+			CIHigh: 0.8},
+		"b": {Abundance: 0.25, Reads: 100, EstReads: 99, MeanDepth: 1,
+			MedianDepth: 1, Copies: 1, StdErr: 0.02, CILow: 0.2, CIHigh: 0.3},
+	}
+	dir := t.TempDir()
+	for _, asJSON := range []bool{false, true} {
+		file := filepath.Join(dir, "out")
+		if err := Write(file, genomes, asJSON, true); err != nil {
+			t.Fatalf("Write(%v) failed: %v", asJSON, err)
+		}
+		got, err := Read(file)
+		if err != nil {
+			t.Fatalf("Read(%v) failed: %v", asJSON, err)
+		}
+		if !reflect.DeepEqual(got, genomes) {
+			t.Errorf("Read(%v)=%v, want %v", asJSON, got, genomes)
+		}
+	}
+}
+
+func TestRead_legacy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "out.tsv")
+	if err := os.WriteFile(file, []byte("a\t0.75\nb\t0.25\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(file)
+	if err != nil {
+		t.Fatalf("Read(...) failed: %v", err)
+	}
+	want := map[string]*abundance.GenomeStats{
+		"a": {Abundance: 0.75}, "b": {Abundance: 0.25}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Read(...)=%v, want %v", got, want)
+	}
+}
+
+func TestRead_legacyJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "out.json")
+	data := `{"a":0.75,"b":{"abundance":0.25,"reads":10}}`
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(file)
+	if err != nil {
+		t.Fatalf("Read(...) failed: %v", err)
+	}
+	want := map[string]*abundance.GenomeStats{
+		"a": {Abundance: 0.75}, "b": {Abundance: 0.25, Reads: 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Read(...)=%v, want %v", got, want)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	tables := []map[string]*abundance.GenomeStats{
+		{"a": {Abundance: 0.5, Reads: 10}, "b": {Abundance: 0.5, Reads: 5}},
+		{"b": {Abundance: 0.25, Reads: 2}, "c": {Abundance: 0.75, Reads: 6}},
+	}
+	value, err := Field("reads")
+	if err != nil {
+		t.Fatalf("Field(reads) failed: %v", err)
+	}
+	m := NewMatrix([]string{"s1", "s2"}, tables, value)
+	m.Filter(func(_ string, v []float64) bool { return !math.IsNaN(v[0]) })
+
+	dir := t.TempDir()
+	wide := filepath.Join(dir, "wide.tsv")
+	if err := m.WriteWide(wide, "NA"); err != nil {
+		t.Fatalf("WriteWide(...) failed: %v", err)
+	}
+	long := filepath.Join(dir, "long.tsv")
+	if err := m.WriteLong(long, "reads"); err != nil {
+		t.Fatalf("WriteLong(...) failed: %v", err)
+	}
+	for _, test := range []struct {
+		file, want string
+	}{
+		{wide, "genome\ts1\ts2\na\t10\tNA\nb\t5\t2\n"},
+		{long, "sample\tgenome\treads\ns1\ta\t10\ns1\tb\t5\ns2\tb\t2\n"},
+	} {
+		got, err := os.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s=%q, want %q", filepath.Base(test.file), got, test.want)
+		}
+	}
+
+	if _, err := Field("genome"); err == nil {
+		t.Errorf("Field(genome) succeeded, want error")
+	}
+}